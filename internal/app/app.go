@@ -1,20 +1,39 @@
 package app
 
 import (
+	"context"
+	"crypto/subtle"
 	"embed"
+	"errors"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/abigpotostew/dingdong/internal/commands"
+	"github.com/abigpotostew/dingdong/internal/config"
 	"github.com/abigpotostew/dingdong/internal/handlers"
+	"github.com/abigpotostew/dingdong/internal/logging"
+	"github.com/abigpotostew/dingdong/internal/metrics"
 	"github.com/abigpotostew/dingdong/internal/migrations"
 
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
 )
 
+var (
+	retentionLog = logging.Component("retention")
+	rollupLog    = logging.Component("rollup")
+)
+
+// webhookLogDays is how long finished webhook deliveries are kept
+const webhookLogDays = 30
+
 //go:embed templates/*
 var templatesFS embed.FS
 
@@ -23,6 +42,17 @@ var staticFS embed.FS
 
 // Run initializes and starts the Pocketbase application
 func Run() error {
+	// Structured logs go to stderr so they don't mix with command output
+	logOptions, err := logging.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	logging.Setup(os.Stderr, logOptions)
+
+	if err := handlers.ConfigureStatsCache(); err != nil {
+		return err
+	}
+
 	app := pocketbase.New()
 
 	// Parse templates
@@ -31,30 +61,82 @@ func Run() error {
 		return err
 	}
 
-	// Register migrations for database schema
+	// Apply schema migrations on bootstrap and add the migrate command
 	migrations.Register(app)
 
+	// Sync sites from dingdong.yaml after the schema is up to date
+	config.Register(app)
+
+	// Enforce per-site retention and prune the webhook log once a day
+	app.Cron().MustAdd("dingdong_retention", "30 3 * * *", func() {
+		deleted, err := handlers.PruneRetention(app)
+		if err != nil {
+			retentionLog.Error("Failed to prune pageviews", "error", err)
+		} else if deleted > 0 {
+			retentionLog.Info("Pruned pageviews past their site's retention", "deleted", deleted)
+		}
+
+		if _, err := handlers.PruneWebhookDeliveries(app, time.Now().AddDate(0, 0, -webhookLogDays)); err != nil {
+			retentionLog.Error("Failed to prune webhook deliveries", "error", err)
+		}
+	})
+
+	// Count each completed hour into the hourly pageview counters. The
+	// rollup also runs on start, to catch up on hours missed while stopped.
+	rollup := func() {
+		if err := handlers.RollupHourly(app); err != nil {
+			rollupLog.Error("Failed to roll up hourly pageviews", "error", err)
+		}
+	}
+	app.Cron().MustAdd("dingdong_rollup", "1 * * * *", rollup)
+
+	// Check traffic alert rules every five minutes
+	app.Cron().MustAdd("dingdong_alerts", "*/5 * * * *", func() {
+		handlers.EvaluateAlerts(app)
+	})
+
+	// Register DingDong CLI commands
+	app.RootCmd.AddCommand(commands.NewPurgeSpamCommand(app))
+	app.RootCmd.AddCommand(commands.NewExportCommand(app))
+	app.RootCmd.AddCommand(commands.NewImportCommand(app))
+	app.RootCmd.AddCommand(commands.NewImportLogsCommand(app))
+	app.RootCmd.AddCommand(commands.NewSitesCommand(app))
+	app.RootCmd.AddCommand(commands.NewStatsCommand(app))
+	app.RootCmd.AddCommand(commands.NewPruneCommand(app))
+	app.RootCmd.AddCommand(commands.NewConfigCommand(app))
+
 	// Setup routes
 	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
 		// Create handlers
 		h := handlers.New(app, tmpl)
 
+		// Tag every request with an ID for its log lines
+		e.Router.BindFunc(withRequestID)
+
 		// PING API endpoint with custom CORS handling
 		e.Router.POST("/api/ping", func(re *core.RequestEvent) error {
 			if err := handlePingCORS(app, h, re); err != nil {
 				return err
 			}
 			return h.HandlePing(re)
-		})
+		}).BindFunc(observeRoute("ping"), checkIngestionToken(app))
 
 		e.Router.OPTIONS("/api/ping", func(re *core.RequestEvent) error {
 			return handlePingPreflight(app, h, re)
-		})
+		}).BindFunc(observeRoute("ping_preflight"))
 
 		// Tracker script endpoint
 		e.Router.GET("/tracker.js", func(re *core.RequestEvent) error {
 			return h.HandleTrackerScript(re)
-		})
+		}).BindFunc(observeRoute("tracker"))
+
+		// Liveness and readiness probes
+		e.Router.GET("/healthz", handleHealthz(app, h))
+		e.Router.GET("/readyz", handleReadyz(app, h))
+
+		// Prometheus metrics
+		registerMetricGauges(app, h)
+		e.Router.GET("/metrics", handleMetrics)
 
 		// Robots.txt - block all crawlers
 		e.Router.GET("/robots.txt", func(re *core.RequestEvent) error {
@@ -71,18 +153,198 @@ func Run() error {
 		// Admin portal routes
 		e.Router.GET("/", func(re *core.RequestEvent) error {
 			return h.HandleDashboard(re)
-		})
+		}).BindFunc(observeRoute("dashboard"), requireDashboardAuth(app))
 		e.Router.GET("/sites", func(re *core.RequestEvent) error {
 			return h.HandleSites(re)
-		})
+		}).BindFunc(observeRoute("sites"), requireDashboardAuth(app))
 		e.Router.GET("/sites/{siteId}", func(re *core.RequestEvent) error {
 			return h.HandleSiteStats(re)
+		}).BindFunc(observeRoute("site_stats"), requireDashboardAuth(app))
+		e.Router.GET("/sites/{siteId}/live", func(re *core.RequestEvent) error {
+			return h.HandleLiveStream(re)
+		}).BindFunc(requireDashboardAuth(app))
+		e.Router.GET("/sites/{siteId}/export/pageviews", func(re *core.RequestEvent) error {
+			return h.HandleExportPageviews(re)
+		}).BindFunc(requireDashboardAuth(app))
+		e.Router.GET("/sites/{siteId}/export/{report}", func(re *core.RequestEvent) error {
+			return h.HandleExportReport(re)
+		}).BindFunc(requireDashboardAuth(app))
+		// Embeddable badges and widgets (sites with public_widget enabled)
+		e.Router.GET("/badge/{file}", func(re *core.RequestEvent) error {
+			return h.HandleBadge(re)
+		})
+		e.Router.GET("/widget/{siteId}", func(re *core.RequestEvent) error {
+			return h.HandleWidget(re)
+		})
+		e.Router.GET("/widget.js", func(re *core.RequestEvent) error {
+			return h.HandleWidgetScript(re)
+		})
+
+		// Public read-only dashboards
+		e.Router.GET("/share/{slug}", func(re *core.RequestEvent) error {
+			return h.HandleSharedStats(re)
+		}).BindFunc(observeRoute("share"))
+		e.Router.POST("/share/{slug}", func(re *core.RequestEvent) error {
+			return h.HandleSharePassword(re)
 		})
+
+		// Signed confirmation and unsubscribe links from site report emails
+		e.Router.GET("/reports/confirm", func(re *core.RequestEvent) error {
+			return h.HandleReportLink(re, handlers.ReportLinkConfirm)
+		})
+		e.Router.POST("/reports/confirm", func(re *core.RequestEvent) error {
+			return h.HandleReportLink(re, handlers.ReportLinkConfirm)
+		})
+		e.Router.GET("/reports/unsubscribe", func(re *core.RequestEvent) error {
+			return h.HandleReportLink(re, handlers.ReportLinkUnsubscribe)
+		})
+		e.Router.POST("/reports/unsubscribe", func(re *core.RequestEvent) error {
+			return h.HandleReportLink(re, handlers.ReportLinkUnsubscribe)
+		})
+
 		e.Router.GET("/admin", func(re *core.RequestEvent) error {
 			return h.HandleAdmin(re)
 		})
 
-		log.Println("DingDong server started")
+		// Versioned JSON stats API
+		api := e.Router.Group("/api/v1")
+		api.BindFunc(observeRoute("api_v1"), requireAPIScope(app, handlers.ScopeStatsRead))
+		api.GET("/sites/{siteId}/stats", func(re *core.RequestEvent) error {
+			return h.HandleAPIStats(re)
+		})
+		api.GET("/sites/{siteId}/timeseries", func(re *core.RequestEvent) error {
+			return h.HandleAPITimeseries(re)
+		})
+		api.GET("/sites/{siteId}/breakdown", func(re *core.RequestEvent) error {
+			return h.HandleAPIBreakdown(re)
+		})
+		api.GET("/sites/{siteId}/export/pageviews", func(re *core.RequestEvent) error {
+			return h.HandleExportPageviews(re)
+		})
+		api.GET("/sites/{siteId}/export/{report}", func(re *core.RequestEvent) error {
+			return h.HandleExportReport(re)
+		})
+
+		// API token management (superusers only)
+		e.Router.POST("/api/admin/tokens", func(re *core.RequestEvent) error {
+			return h.HandleCreateAPIToken(re)
+		}).Bind(apis.RequireSuperuserAuth())
+
+		// Site membership management (owners and superusers, checked in the handlers)
+		members := e.Router.Group("/api/admin/sites/{siteId}/members")
+		members.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		members.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListSiteMembers(re)
+		})
+		members.POST("", func(re *core.RequestEvent) error {
+			return h.HandleSetSiteMember(re)
+		})
+		members.DELETE("/{userId}", func(re *core.RequestEvent) error {
+			return h.HandleRemoveSiteMember(re)
+		})
+
+		// Share link management (editors, owners and superusers, checked in the handlers)
+		shares := e.Router.Group("/api/admin/sites/{siteId}/shares")
+		shares.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		shares.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListShareLinks(re)
+		})
+		shares.POST("", func(re *core.RequestEvent) error {
+			return h.HandleCreateShareLink(re)
+		})
+		shares.DELETE("/{shareId}", func(re *core.RequestEvent) error {
+			return h.HandleDeleteShareLink(re)
+		})
+
+		// Email report subscriptions (members, checked in the handlers)
+		reports := e.Router.Group("/api/admin/sites/{siteId}/reports")
+		reports.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		reports.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListReports(re)
+		})
+		reports.POST("", func(re *core.RequestEvent) error {
+			return h.HandleCreateReport(re)
+		})
+		reports.POST("/test", func(re *core.RequestEvent) error {
+			return h.HandleTestReport(re)
+		})
+		reports.DELETE("/{reportId}", func(re *core.RequestEvent) error {
+			return h.HandleDeleteReport(re)
+		})
+
+		// Per-user reports of every site the signed-in account can view
+		userReports := e.Router.Group("/api/admin/reports")
+		userReports.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		userReports.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListUserReports(re)
+		})
+		userReports.POST("", func(re *core.RequestEvent) error {
+			return h.HandleCreateUserReport(re)
+		})
+		userReports.POST("/test", func(re *core.RequestEvent) error {
+			return h.HandleTestUserReport(re)
+		})
+		userReports.DELETE("/{reportId}", func(re *core.RequestEvent) error {
+			return h.HandleDeleteUserReport(re)
+		})
+
+		// Traffic alert rules and history (editors, owners and superusers, checked in the handlers)
+		alerts := e.Router.Group("/api/admin/sites/{siteId}/alerts")
+		alerts.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		alerts.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListAlertRules(re)
+		})
+		alerts.POST("", func(re *core.RequestEvent) error {
+			return h.HandleCreateAlertRule(re)
+		})
+		alerts.GET("/history", func(re *core.RequestEvent) error {
+			return h.HandleAlertHistory(re)
+		})
+		alerts.PATCH("/{ruleId}", func(re *core.RequestEvent) error {
+			return h.HandleUpdateAlertRule(re)
+		})
+		alerts.DELETE("/{ruleId}", func(re *core.RequestEvent) error {
+			return h.HandleDeleteAlertRule(re)
+		})
+
+		// Outgoing webhooks and their delivery log (editors, owners and superusers, checked in the handlers)
+		webhooks := e.Router.Group("/api/admin/sites/{siteId}/webhooks")
+		webhooks.Bind(apis.RequireAuth(core.CollectionNameSuperusers, "users"))
+		webhooks.GET("", func(re *core.RequestEvent) error {
+			return h.HandleListWebhooks(re)
+		})
+		webhooks.POST("", func(re *core.RequestEvent) error {
+			return h.HandleCreateWebhook(re)
+		})
+		webhooks.GET("/deliveries", func(re *core.RequestEvent) error {
+			return h.HandleListWebhookDeliveries(re)
+		})
+		webhooks.POST("/deliveries/{deliveryId}/replay", func(re *core.RequestEvent) error {
+			return h.HandleReplayWebhookDelivery(re)
+		})
+		webhooks.PATCH("/{webhookId}", func(re *core.RequestEvent) error {
+			return h.HandleUpdateWebhook(re)
+		})
+		webhooks.DELETE("/{webhookId}", func(re *core.RequestEvent) error {
+			return h.HandleDeleteWebhook(re)
+		})
+
+		// Deliver webhooks in the background until the app shuts down, and
+		// drop cached stats when a CLI command changes pageviews
+		ctx, cancel := context.WithCancel(context.Background())
+		go h.RunWebhooks(ctx)
+		go handlers.WatchStatsCache(ctx, app)
+		app.OnTerminate().BindFunc(func(te *core.TerminateEvent) error {
+			cancel()
+			return te.Next()
+		})
+
+		// Send weekly and monthly reports once their period has ended
+		app.Cron().MustAdd("dingdong_reports", "5 * * * *", h.SendDueReports)
+
+		rollup()
+
+		slog.Info("DingDong server started")
 		return e.Next()
 	})
 
@@ -95,6 +357,136 @@ func Run() error {
 	return app.Start()
 }
 
+// requireAPIScope authorizes JSON API requests with a PocketBase superuser
+// auth token, the API_TOKEN env value or an api_tokens token granted scope.
+// Routes with a {siteId} path param are also checked against the token's sites,
+// and accept the auth token of a user who is a member of that site.
+func requireAPIScope(app *pocketbase.PocketBase, scope string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.HasSuperuserAuth() {
+			return e.Next()
+		}
+
+		if siteId := e.Request.PathValue("siteId"); e.Auth != nil && siteId != "" {
+			if !handlers.HasSiteRole(app, e.Auth, siteId, handlers.RoleViewer) {
+				return e.JSON(http.StatusForbidden, map[string]string{"error": "Not a member of this site"})
+			}
+			return e.Next()
+		}
+
+		if status, message := authorizeAPIToken(app, e, scope); status != 0 {
+			return e.JSON(status, map[string]string{"error": message})
+		}
+
+		return e.Next()
+	}
+}
+
+// requestIDHeader carries the request ID between DingDong, proxies and clients
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID stores the proxy's X-Request-ID, or a new ID, in the request
+// context so log lines written while handling it can be told apart, and
+// echoes it in the response
+func withRequestID(e *core.RequestEvent) error {
+	id := e.Request.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = security.RandomString(20)
+	}
+
+	e.Response.Header().Set(requestIDHeader, id)
+	e.Request = e.Request.WithContext(logging.WithRequestID(e.Request.Context(), id))
+	return e.Next()
+}
+
+// validRequestID accepts short IDs of letters, digits and -_. so a client
+// can't inject anything else into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// dashboardAuthCookie holds the PocketBase auth token for server-rendered pages.
+// admin.html keeps it in sync with the SDK auth store.
+const dashboardAuthCookie = "dd_auth"
+
+// requireDashboardAuth loads the signed-in superuser or user from the
+// dashboard auth cookie and sends anonymous visitors to the login page
+func requireDashboardAuth(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			if cookie, err := e.Request.Cookie(dashboardAuthCookie); err == nil {
+				if record, err := app.FindAuthRecordByToken(cookie.Value, core.TokenTypeAuth); err == nil {
+					e.Auth = record
+				}
+			}
+		}
+
+		if e.Auth == nil {
+			return e.Redirect(http.StatusFound, "/admin")
+		}
+
+		return e.Next()
+	}
+}
+
+// checkIngestionToken enforces the events:write scope on /api/ping requests that
+// carry a bearer token (e.g. server-side ingestion). Anonymous browser pings are
+// still accepted and validated by origin as before.
+func checkIngestionToken(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Request.Header.Get("Authorization") == "" {
+			return e.Next()
+		}
+
+		if status, message := authorizeAPIToken(app, e, handlers.ScopeEventsWrite); status != 0 {
+			return e.JSON(status, map[string]string{"error": message})
+		}
+
+		return e.Next()
+	}
+}
+
+// authorizeAPIToken validates the request's bearer token for scope and returns
+// the HTTP status and message to reject it with, or a zero status if allowed.
+// api_tokens records are stored on the request under handlers.APITokenKey.
+func authorizeAPIToken(app *pocketbase.PocketBase, e *core.RequestEvent, scope string) (int, string) {
+	token := strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+
+	// The API_TOKEN env value is a legacy full-access token
+	if expected := os.Getenv("API_TOKEN"); expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+		return 0, ""
+	}
+
+	record, err := handlers.FindAPIToken(app, token)
+	if errors.Is(err, handlers.ErrAPITokenExpired) {
+		return http.StatusUnauthorized, "API token has expired"
+	}
+	if err != nil {
+		return http.StatusUnauthorized, "Invalid or missing API token"
+	}
+
+	if !handlers.TokenHasScope(record, scope) {
+		return http.StatusForbidden, "API token is missing the " + scope + " scope"
+	}
+
+	if siteId := e.Request.PathValue("siteId"); siteId != "" && !handlers.TokenAllowsSite(record, siteId) {
+		return http.StatusForbidden, "API token is not allowed to access this site"
+	}
+
+	handlers.TouchAPIToken(app, record)
+	e.Set(handlers.APITokenKey, record)
+
+	return 0, ""
+}
+
 // handlePingCORS sets CORS headers for POST requests to /api/ping
 func handlePingCORS(app *pocketbase.PocketBase, h *handlers.Handlers, e *core.RequestEvent) error {
 	origin := e.Request.Header.Get("Origin")
@@ -144,6 +536,7 @@ func handlePingPreflight(app *pocketbase.PocketBase, h *handlers.Handlers, e *co
 	_, err = handlers.FindSiteByDomain(app, domain)
 	if err != nil {
 		// Record denied pageview
+		handlers.CountPing(nil, metrics.PingDenied, "cors_preflight_denied")
 		h.RecordDeniedPageview(e, domain, origin, "cors_preflight_denied", nil)
 		return e.NoContent(http.StatusForbidden)
 	}
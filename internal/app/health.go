@@ -0,0 +1,141 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+	"github.com/abigpotostew/dingdong/internal/logging"
+	"github.com/abigpotostew/dingdong/internal/migrations"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var healthLog = logging.Component("health")
+
+// healthCheckTimeout bounds the database check, so a wedged database fails
+// the check instead of hanging the orchestrator's probe
+const healthCheckTimeout = 5 * time.Second
+
+// errHealthRollback undoes the database check's test write
+var errHealthRollback = errors.New("health check rollback")
+
+// HealthCheck is the result of a single check
+type HealthCheck struct {
+	Status     string `json:"status"` // "ok" or "error"
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Details    any    `json:"details,omitempty"`
+}
+
+// HealthReport is the body of /healthz and /readyz
+type HealthReport struct {
+	Status string                 `json:"status"` // "ok" or "error"
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// healthCheckFunc returns optional details and an error if the check failed
+type healthCheckFunc func() (any, error)
+
+// handleHealthz reports whether this instance is alive: the database takes
+// writes and the webhook worker is making progress. Orchestrators should
+// restart the instance when it fails.
+func handleHealthz(app *pocketbase.PocketBase, h *handlers.Handlers) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return writeHealthReport(e, map[string]healthCheckFunc{
+			"database": func() (any, error) { return nil, checkDatabase(app) },
+			"webhooks": func() (any, error) { return checkWebhooks(h, false) },
+		})
+	}
+}
+
+// handleReadyz reports whether this instance should receive traffic: it is
+// alive, all migrations are applied, the webhook queue has room and the
+// tracker script can be served
+func handleReadyz(app *pocketbase.PocketBase, h *handlers.Handlers) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return writeHealthReport(e, map[string]healthCheckFunc{
+			"migrations": func() (any, error) { return migrations.Check(app) },
+			"database":   func() (any, error) { return nil, checkDatabase(app) },
+			"webhooks":   func() (any, error) { return checkWebhooks(h, true) },
+			"tracker":    func() (any, error) { return nil, handlers.CheckTrackerScript() },
+		})
+	}
+}
+
+// writeHealthReport runs the checks and responds with 200 if all passed, 503 otherwise
+func writeHealthReport(e *core.RequestEvent, checks map[string]healthCheckFunc) error {
+	report := HealthReport{Status: "ok", Checks: map[string]HealthCheck{}}
+
+	for name, check := range checks {
+		start := time.Now()
+		details, err := check()
+
+		result := HealthCheck{Status: "ok", DurationMs: time.Since(start).Milliseconds(), Details: details}
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			report.Status = "error"
+			healthLog.WarnContext(e.Request.Context(), "Health check failed", "path", e.Request.URL.Path, "check", name, "error", err)
+		}
+		report.Checks[name] = result
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	e.Response.Header().Set("Cache-Control", "no-store")
+	return e.JSON(status, report)
+}
+
+// checkDatabase makes a write that is rolled back, to check that the database
+// file is writable and its write lock can be taken
+func checkDatabase(app *pocketbase.PocketBase) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- app.RunInTransaction(func(txApp core.App) error {
+			if _, err := txApp.DB().NewQuery("CREATE TABLE _dingdong_health (id INTEGER)").Execute(); err != nil {
+				return err
+			}
+			return errHealthRollback
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, errHealthRollback) {
+			return nil
+		}
+		return err
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("no write within %s", healthCheckTimeout)
+	}
+}
+
+// checkWebhooks fails if the webhook worker stopped or is stuck and, for
+// readiness, if its queue is full so new pageviews would skip their webhooks
+func checkWebhooks(h *handlers.Handlers, ready bool) (any, error) {
+	status := h.WebhookStatus()
+	details := map[string]any{
+		"queue_depth": status.QueueDepth,
+		"queue_size":  status.QueueSize,
+	}
+	if !status.LastActive.IsZero() {
+		details["last_active"] = status.LastActive.UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case !status.Running:
+		return details, errors.New("webhook worker is not running")
+	case status.Stalled:
+		return details, errors.New("webhook worker has stalled")
+	case ready && status.QueueDepth >= status.QueueSize:
+		return details, errors.New("webhook queue is full")
+	}
+	return details, nil
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+	"github.com/abigpotostew/dingdong/internal/logging"
+	"github.com/abigpotostew/dingdong/internal/metrics"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+var metricsLog = logging.Component("metrics")
+
+// registerMetricGauges adds the gauges that are read from the app on each scrape
+func registerMetricGauges(app *pocketbase.PocketBase, h *handlers.Handlers) {
+	metrics.NewGaugeFunc("dingdong_db_size_bytes", "Size of the SQLite database files, including the WAL.", func(set func(float64, ...string)) {
+		for _, db := range []string{"data", "auxiliary"} {
+			var size int64
+			for _, name := range []string{db + ".db", db + ".db-wal"} {
+				if info, err := os.Stat(filepath.Join(app.DataDir(), name)); err == nil {
+					size += info.Size()
+				}
+			}
+			set(float64(size), db)
+		}
+	}, "db")
+
+	metrics.NewGaugeFunc("dingdong_stats_cache_entries", "Stats query results held in the cache.", func(set func(float64, ...string)) {
+		set(float64(handlers.StatsCacheSize()))
+	})
+
+	metrics.NewGaugeFunc("dingdong_webhook_queue_depth", "Pageviews waiting to be matched against webhooks.", func(set func(float64, ...string)) {
+		set(float64(h.WebhookStatus().QueueDepth))
+	})
+
+	metrics.NewGaugeFunc("dingdong_webhook_deliveries_pending", "Webhook deliveries waiting to be sent or retried.", func(set func(float64, ...string)) {
+		count, err := handlers.CountPendingWebhookDeliveries(app)
+		if err != nil {
+			metricsLog.Error("Failed to count pending webhook deliveries", "error", err)
+			return
+		}
+		set(float64(count))
+	})
+}
+
+// observeRoute records the latency and status code of requests to route
+func observeRoute(route string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		start := time.Now()
+		err := e.Next()
+
+		status := e.Status()
+		if status == 0 {
+			// Errors are written by the router after the middleware chain returns
+			var apiErr *router.ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.Status
+			case err != nil:
+				status = http.StatusInternalServerError
+			default:
+				status = http.StatusOK
+			}
+		}
+
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), route, strconv.Itoa(status))
+		return err
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format. If METRICS_TOKEN
+// is set, scrapers must send it as a bearer token.
+func handleMetrics(e *core.RequestEvent) error {
+	if expected := os.Getenv("METRICS_TOKEN"); expected != "" {
+		token := strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			return e.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or missing metrics token"})
+		}
+	}
+
+	e.Response.Header().Set("Content-Type", metrics.ContentType)
+	e.Response.Header().Set("Cache-Control", "no-store")
+	e.Response.WriteHeader(http.StatusOK)
+	return metrics.Write(e.Response)
+}
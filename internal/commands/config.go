@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/abigpotostew/dingdong/internal/config"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewConfigCommand creates the command that reconciles sites with dingdong.yaml
+func NewConfigCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "config",
+		Short: "Manage sites declared in dingdong.yaml",
+	}
+
+	var file string
+	var dryRun bool
+
+	apply := &cobra.Command{
+		Use:          "apply",
+		Short:        "Create and update the sites declared in the config file",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if file == "" {
+				file = config.Path()
+			}
+			if file == "" {
+				return errors.New("no dingdong.yaml found, pass --file or set DINGDONG_CONFIG")
+			}
+
+			cfg, err := config.Load(file)
+			if err != nil {
+				return err
+			}
+
+			changes, err := config.Apply(app, cfg, dryRun)
+			if err != nil {
+				return err
+			}
+
+			for _, change := range changes {
+				fmt.Println(change)
+			}
+			switch {
+			case len(changes) == 0:
+				fmt.Println("Sites are up to date")
+			case dryRun:
+				fmt.Printf("%d changes would be applied (dry run)\n", len(changes))
+			default:
+				fmt.Printf("Applied %d changes\n", len(changes))
+			}
+			return nil
+		},
+	}
+	apply.Flags().StringVar(&file, "file", "", "config file (default: $DINGDONG_CONFIG or ./dingdong.yaml)")
+	apply.Flags().BoolVar(&dryRun, "dry-run", false, "print the changes without applying them")
+
+	command.AddCommand(apply)
+
+	return command
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewExportCommand creates the command that writes raw pageviews as
+// partitioned Parquet files for loading into a data warehouse
+func NewExportCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var format, siteId, from, to, outDir string
+
+	command := &cobra.Command{
+		Use:          "export",
+		Short:        "Export raw pageviews as partitioned Parquet files",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if format != "parquet" {
+				return fmt.Errorf("unsupported format %q, only parquet is supported", format)
+			}
+
+			q := handlers.StatsQuery{}
+			if from != "" {
+				parsed, err := time.Parse("2006-01-02", from)
+				if err != nil {
+					return fmt.Errorf("--from must be a YYYY-MM-DD date")
+				}
+				q.From = parsed
+			}
+			if to != "" {
+				parsed, err := time.Parse("2006-01-02", to)
+				if err != nil {
+					return fmt.Errorf("--to must be a YYYY-MM-DD date")
+				}
+				// --to is inclusive
+				q.To = parsed.AddDate(0, 0, 1)
+			}
+
+			siteIds := []string{siteId}
+			if siteId == "" {
+				sites, err := app.FindRecordsByFilter("sites", "1=1", "created", 0, 0)
+				if err != nil {
+					return err
+				}
+				siteIds = siteIds[:0]
+				for _, site := range sites {
+					siteIds = append(siteIds, site.Id)
+				}
+			} else if _, err := app.FindRecordById("sites", siteId); err != nil {
+				return fmt.Errorf("site %s not found", siteId)
+			}
+
+			totalFiles, totalRows := 0, 0
+			for _, id := range siteIds {
+				q.SiteID = id
+				files, rows, err := handlers.WriteParquetPartitions(app, q, func(name string) (io.WriteCloser, error) {
+					path := filepath.Join(outDir, filepath.FromSlash(name))
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						return nil, err
+					}
+					// Re-exporting a day replaces its partition
+					return os.Create(path)
+				})
+				if err != nil {
+					return fmt.Errorf("export of site %s failed: %w", id, err)
+				}
+				totalFiles += files
+				totalRows += rows
+			}
+
+			fmt.Printf("Wrote %d pageviews to %d files in %s\n", totalRows, totalFiles, outDir)
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&format, "format", "parquet", "output format (parquet)")
+	command.Flags().StringVar(&siteId, "site", "", "only export the site with this ID")
+	command.Flags().StringVar(&from, "from", "", "first day to export, YYYY-MM-DD (default: oldest pageview)")
+	command.Flags().StringVar(&to, "to", "", "last day to export, YYYY-MM-DD (default: newest pageview)")
+	command.Flags().StringVar(&outDir, "out", "export", "directory to write site=<id>/date=<day>/pageviews.parquet files to")
+
+	return command
+}
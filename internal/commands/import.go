@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewImportCommand creates the command that imports historical daily stats
+// from Plausible and Google Analytics 4 exports
+func NewImportCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var siteId string
+
+	command := &cobra.Command{
+		Use:   "import",
+		Short: "Import historical stats from Plausible or Google Analytics",
+	}
+	command.PersistentFlags().StringVar(&siteId, "site", "", "ID of the site to import into (required)")
+	command.MarkPersistentFlagRequired("site")
+
+	command.AddCommand(&cobra.Command{
+		Use:          "plausible <export.zip>",
+		Short:        "Import a Plausible CSV export zip",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := checkImportSite(app, siteId); err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			stats, err := handlers.ParsePlausibleExport(f, info.Size())
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+
+			return saveImport(app, siteId, handlers.ImportSourcePlausible, stats)
+		},
+	})
+
+	command.AddCommand(&cobra.Command{
+		Use:          "ga4 <report.csv>...",
+		Short:        "Import GA4 report CSVs with a Date dimension",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := checkImportSite(app, siteId); err != nil {
+				return err
+			}
+
+			var stats []handlers.ImportedStat
+			for _, name := range args {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				fileStats, err := handlers.ParseGA4CSV(f)
+				f.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				stats = append(stats, fileStats...)
+			}
+
+			return saveImport(app, siteId, handlers.ImportSourceGA4, stats)
+		},
+	})
+
+	var source string
+	deleteCommand := &cobra.Command{
+		Use:          "delete",
+		Short:        "Delete a site's imported stats",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := checkImportSite(app, siteId); err != nil {
+				return err
+			}
+
+			count, err := handlers.DeleteImportedStats(app, siteId, source)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Deleted %d imported rows\n", count)
+			return nil
+		},
+	}
+	deleteCommand.Flags().StringVar(&source, "source", "", "only delete stats imported from plausible or ga4")
+	command.AddCommand(deleteCommand)
+
+	return command
+}
+
+// checkImportSite makes sure the site exists and the database has been set up
+func checkImportSite(app *pocketbase.PocketBase, siteId string) error {
+	if _, err := app.FindCollectionByNameOrId("imported_stats"); err != nil {
+		return fmt.Errorf("imported_stats collection not found, start the server once to create it")
+	}
+	if _, err := app.FindRecordById("sites", siteId); err != nil {
+		return fmt.Errorf("site %s not found", siteId)
+	}
+	return nil
+}
+
+// saveImport stores parsed stats and reports what was imported
+func saveImport(app *pocketbase.PocketBase, siteId, source string, stats []handlers.ImportedStat) error {
+	result, err := handlers.SaveImportedStats(app, siteId, source, stats)
+	if err != nil {
+		return err
+	}
+
+	if result.Rows == 0 {
+		fmt.Println("Nothing to import")
+	} else {
+		fmt.Printf("Imported %d rows from %s to %s\n", result.Rows, result.From, result.To)
+	}
+	if result.SkippedDays > 0 {
+		fmt.Printf("Skipped %d days already tracked by DingDong\n", result.SkippedDays)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+// NewImportLogsCommand creates the command that imports pageviews from web
+// server access logs, for sites that can't run the tracker
+func NewImportLogsCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var siteId, format string
+
+	command := &cobra.Command{
+		Use:          "import-logs <access.log>...",
+		Short:        "Import pageviews from web server access logs",
+		Long:         "Import pageviews from access logs. Files ending in .gz are decompressed and - reads from stdin. Lines that were already imported are skipped.",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if !slices.Contains(handlers.AccessLogFormats, format) {
+				return fmt.Errorf("--format must be one of: %s", strings.Join(handlers.AccessLogFormats, ", "))
+			}
+
+			site, err := app.FindRecordById("sites", siteId)
+			if err != nil {
+				return fmt.Errorf("site %s not found", siteId)
+			}
+
+			for _, name := range args {
+				result, err := importLogFile(app, site, format, name)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+
+				fmt.Printf("%s: %d lines, %d pageviews imported, %d already imported, %d filtered, %d invalid\n",
+					name, result.Lines, result.Imported, result.Duplicates, result.Filtered, result.Invalid)
+			}
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&siteId, "site", "", "ID of the site to import into (required)")
+	command.Flags().StringVar(&format, "format", handlers.AccessLogCombined, "log format: "+strings.Join(handlers.AccessLogFormats, ", "))
+	command.MarkFlagRequired("site")
+
+	return command
+}
+
+// importLogFile imports a single (optionally gzipped) log file, or stdin for "-"
+func importLogFile(app *pocketbase.PocketBase, site *core.Record, format, name string) (handlers.AccessLogResult, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return handlers.AccessLogResult{}, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return handlers.AccessLogResult{}, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return handlers.ImportAccessLog(app, site, format, r)
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewPruneCommand creates the command that deletes pageviews past a retention period
+func NewPruneCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var olderThan, siteRef string
+	var dryRun bool
+
+	command := &cobra.Command{
+		Use:          "prune",
+		Short:        "Delete pageviews older than a retention period",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			days, err := strconv.Atoi(strings.TrimSuffix(olderThan, "d"))
+			if err != nil || days < 1 {
+				return fmt.Errorf("--older-than must be a number of days, like 395d")
+			}
+
+			siteId := ""
+			if siteRef != "" {
+				site, err := findSite(app, siteRef)
+				if err != nil {
+					return err
+				}
+				siteId = site.Id
+			}
+
+			before := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+			result, err := handlers.PruneOldData(app, siteId, before, dryRun)
+			if err != nil {
+				return err
+			}
+
+			verb := "Deleted"
+			if dryRun {
+				verb = "Would delete"
+			}
+			fmt.Printf("%s %d pageviews and %d denied pageviews from before %s\n",
+				verb, result.Pageviews, result.Denied, before.Format("2006-01-02"))
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&olderThan, "older-than", "", "retention period in days, e.g. 395d (required)")
+	command.Flags().StringVar(&siteRef, "site", "", "only prune the site with this ID or domain")
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "count matching rows without deleting them")
+	command.MarkFlagRequired("older-than")
+
+	return command
+}
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewPurgeSpamCommand creates the command that retroactively deletes
+// pageviews matching the referrer spam list and per-site block patterns
+func NewPurgeSpamCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var siteId string
+	var dryRun bool
+
+	command := &cobra.Command{
+		Use:          "purge-spam",
+		Short:        "Delete historical pageviews with spam referrers",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			count, err := handlers.PurgeReferrerSpam(app, siteId, dryRun)
+			if err != nil {
+				return err
+			}
+
+			if dryRun {
+				fmt.Printf("%d spam pageviews would be deleted\n", count)
+			} else {
+				fmt.Printf("Deleted %d spam pageviews\n", count)
+			}
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&siteId, "site", "", "only purge the site with this ID")
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "count matching pageviews without deleting them")
+
+	return command
+}
@@ -0,0 +1,299 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+// siteJSON is a site as printed by `sites list --json`
+type siteJSON struct {
+	ID                 string `json:"id"`
+	Name               string `json:"name"`
+	Domain             string `json:"domain"`
+	AdditionalDomains  string `json:"additional_domains"`
+	Active             bool   `json:"active"`
+	ReferrerSpamAction string `json:"referrer_spam_action"`
+	PrivacySignals     string `json:"privacy_signals"`
+	PublicWidget       bool   `json:"public_widget"`
+	Timezone           string `json:"timezone"`
+	RetentionDays      int    `json:"retention_days"`
+	Managed            bool   `json:"managed"`
+	Created            string `json:"created"`
+}
+
+// NewSitesCommand creates the command for managing sites from scripts
+func NewSitesCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "sites",
+		Short: "List, add, update, disable and delete sites",
+	}
+
+	command.AddCommand(
+		newSitesListCommand(app),
+		newSitesAddCommand(app),
+		newSitesUpdateCommand(app),
+		newSitesDisableCommand(app),
+		newSitesDeleteCommand(app),
+	)
+
+	return command
+}
+
+func newSitesListCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var asJSON bool
+
+	command := &cobra.Command{
+		Use:          "list",
+		Short:        "List all sites",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			sites, err := app.FindRecordsByFilter("sites", "1=1", "created", 0, 0)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				result := make([]siteJSON, len(sites))
+				for i, site := range sites {
+					result[i] = toSiteJSON(site)
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(result)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tDOMAIN\tACTIVE\tADDITIONAL DOMAINS")
+			for _, site := range sites {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n",
+					site.Id, site.GetString("name"), site.GetString("domain"), site.GetBool("active"), site.GetString("additional_domains"))
+			}
+			return w.Flush()
+		},
+	}
+
+	command.Flags().BoolVar(&asJSON, "json", false, "print the sites as JSON")
+
+	return command
+}
+
+func newSitesAddCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var name, domain, additionalDomains, owner string
+	var inactive bool
+
+	command := &cobra.Command{
+		Use:          "add",
+		Short:        "Add a site and print its ID",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if existing, _ := app.FindFirstRecordByFilter("sites", "domain = {:domain}", dbx.Params{"domain": domain}); existing != nil {
+				return fmt.Errorf("a site for %s already exists: %s", domain, existing.Id)
+			}
+
+			var user *core.Record
+			if owner != "" {
+				var err error
+				if user, err = app.FindAuthRecordByEmail("users", owner); err != nil {
+					return fmt.Errorf("no user with email %s", owner)
+				}
+			}
+
+			collection, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			site := core.NewRecord(collection)
+			site.Set("name", name)
+			site.Set("domain", domain)
+			site.Set("additional_domains", additionalDomains)
+			site.Set("active", !inactive)
+			if name == "" {
+				site.Set("name", domain)
+			}
+
+			if err := app.Save(site); err != nil {
+				return err
+			}
+
+			if user != nil {
+				if err := handlers.SetSiteMember(app, site.Id, user.Id, handlers.RoleOwner); err != nil {
+					return err
+				}
+			}
+
+			fmt.Println(site.Id)
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&domain, "domain", "", "primary domain of the site (required)")
+	command.Flags().StringVar(&name, "name", "", "display name (default: the domain)")
+	command.Flags().StringVar(&additionalDomains, "additional-domains", "", "comma-separated additional domains")
+	command.Flags().StringVar(&owner, "owner", "", "email of a user to make the site's owner")
+	command.Flags().BoolVar(&inactive, "inactive", false, "create the site without accepting pageviews yet")
+	command.MarkFlagRequired("domain")
+
+	return command
+}
+
+func newSitesUpdateCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var name, domain, additionalDomains, referrerBlocklist, referrerSpamAction, excludedIPs, privacySignals string
+	var active, publicWidget bool
+
+	command := &cobra.Command{
+		Use:          "update <site>",
+		Short:        "Update a site by ID or domain; only the given flags are changed",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findSite(app, args[0])
+			if err != nil {
+				return err
+			}
+
+			flags := command.Flags()
+			values := map[string]any{
+				"name":                 name,
+				"domain":               strings.ToLower(strings.TrimSpace(domain)),
+				"additional-domains":   additionalDomains,
+				"referrer-blocklist":   referrerBlocklist,
+				"referrer-spam-action": referrerSpamAction,
+				"excluded-ips":         excludedIPs,
+				"privacy-signals":      privacySignals,
+				"active":               active,
+				"public-widget":        publicWidget,
+			}
+			changed := false
+			for flag, value := range values {
+				if flags.Changed(flag) {
+					site.Set(strings.ReplaceAll(flag, "-", "_"), value)
+					changed = true
+				}
+			}
+			if !changed {
+				return fmt.Errorf("nothing to update, pass at least one flag")
+			}
+
+			if err := app.Save(site); err != nil {
+				return err
+			}
+
+			fmt.Printf("Updated %s (%s)\n", site.Id, site.GetString("domain"))
+			return nil
+		},
+	}
+
+	flags := command.Flags()
+	flags.StringVar(&name, "name", "", "display name")
+	flags.StringVar(&domain, "domain", "", "primary domain")
+	flags.StringVar(&additionalDomains, "additional-domains", "", "comma-separated additional domains")
+	flags.StringVar(&referrerBlocklist, "referrer-blocklist", "", "comma-separated referrer domains to block")
+	flags.StringVar(&referrerSpamAction, "referrer-spam-action", "", "reject or flag")
+	flags.StringVar(&excludedIPs, "excluded-ips", "", "comma-separated IPs and CIDR ranges to ignore")
+	flags.StringVar(&privacySignals, "privacy-signals", "", "ignore, drop or anonymize")
+	flags.BoolVar(&active, "active", true, "accept pageviews for the site")
+	flags.BoolVar(&publicWidget, "public-widget", false, "enable the public badge and widget")
+
+	return command
+}
+
+func newSitesDisableCommand(app *pocketbase.PocketBase) *cobra.Command {
+	return &cobra.Command{
+		Use:          "disable <site>",
+		Short:        "Stop accepting pageviews for a site, keeping its data",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findSite(app, args[0])
+			if err != nil {
+				return err
+			}
+
+			site.Set("active", false)
+			if err := app.Save(site); err != nil {
+				return err
+			}
+
+			fmt.Printf("Disabled %s (%s)\n", site.Id, site.GetString("domain"))
+			return nil
+		},
+	}
+}
+
+func newSitesDeleteCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var yes bool
+
+	command := &cobra.Command{
+		Use:          "delete <site>",
+		Short:        "Delete a site and all of its pageviews",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findSite(app, args[0])
+			if err != nil {
+				return err
+			}
+
+			if !yes {
+				return fmt.Errorf("deleting %s removes all of its pageviews, pass --yes to confirm", site.GetString("domain"))
+			}
+
+			if err := app.Delete(site); err != nil {
+				return err
+			}
+
+			fmt.Printf("Deleted %s (%s)\n", site.Id, site.GetString("domain"))
+			return nil
+		},
+	}
+
+	command.Flags().BoolVar(&yes, "yes", false, "confirm deleting the site and its data")
+
+	return command
+}
+
+// findSite looks up a site by ID or primary domain
+func findSite(app *pocketbase.PocketBase, ref string) (*core.Record, error) {
+	if site, err := app.FindRecordById("sites", ref); err == nil {
+		return site, nil
+	}
+
+	site, err := app.FindFirstRecordByFilter("sites", "domain = {:domain}", dbx.Params{"domain": strings.ToLower(ref)})
+	if err != nil {
+		return nil, fmt.Errorf("site %s not found", ref)
+	}
+	return site, nil
+}
+
+// toSiteJSON converts a sites record for JSON output
+func toSiteJSON(site *core.Record) siteJSON {
+	return siteJSON{
+		ID:                 site.Id,
+		Name:               site.GetString("name"),
+		Domain:             site.GetString("domain"),
+		AdditionalDomains:  site.GetString("additional_domains"),
+		Active:             site.GetBool("active"),
+		ReferrerSpamAction: site.GetString("referrer_spam_action"),
+		PrivacySignals:     site.GetString("privacy_signals"),
+		PublicWidget:       site.GetBool("public_widget"),
+		Timezone:           site.GetString("timezone"),
+		RetentionDays:      site.GetInt("retention_days"),
+		Managed:            site.GetBool("managed"),
+		Created:            site.GetDateTime("created").Time().Format(time.RFC3339),
+	}
+}
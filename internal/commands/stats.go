@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/abigpotostew/dingdong/internal/handlers"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+// NewStatsCommand creates the command that prints a site's stats for a range
+func NewStatsCommand(app *pocketbase.PocketBase) *cobra.Command {
+	var rangeParam string
+	var limit int
+	var asJSON bool
+
+	command := &cobra.Command{
+		Use:          "stats <site>",
+		Short:        "Print pageviews, visitors, top pages and referrers of a site",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findSite(app, args[0])
+			if err != nil {
+				return err
+			}
+
+			from, to, _, err := handlers.ParseRange(rangeParam)
+			if err != nil {
+				return err
+			}
+
+			q := handlers.StatsQuery{SiteID: site.Id, From: from, To: to}
+			total, err := handlers.QueryAggregate(app, q)
+			if err != nil {
+				return err
+			}
+			pages, err := handlers.QueryBreakdown(app, q, "path", limit, 0)
+			if err != nil {
+				return err
+			}
+			referrers, err := handlers.QueryBreakdown(app, q, "referrer", limit, 0)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(map[string]any{
+					"site_id":   site.Id,
+					"range":     rangeParam,
+					"pageviews": total.Pageviews,
+					"visitors":  total.Visitors,
+					"pages":     pages,
+					"referrers": referrers,
+				})
+			}
+
+			fmt.Printf("%s (%s)\n\n", site.GetString("domain"), rangeParam)
+			fmt.Printf("Pageviews  %d\nVisitors   %d\n", total.Pageviews, total.Visitors)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, section := range []struct {
+				title string
+				items []handlers.BreakdownItem
+			}{{"PAGE", pages}, {"REFERRER", referrers}} {
+				if len(section.items) == 0 {
+					continue
+				}
+				fmt.Fprintf(w, "\n%s\tPAGEVIEWS\tVISITORS\n", section.title)
+				for _, item := range section.items {
+					fmt.Fprintf(w, "%s\t%d\t%d\n", item.Value, item.Pageviews, item.Visitors)
+				}
+			}
+			return w.Flush()
+		},
+	}
+
+	command.Flags().StringVar(&rangeParam, "range", "30d", "time range: 1d-366d, 1h-168h, today or all")
+	command.Flags().IntVar(&limit, "limit", 10, "number of top pages and referrers to show")
+	command.Flags().BoolVar(&asJSON, "json", false, "print the stats as JSON")
+
+	return command
+}
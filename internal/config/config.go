@@ -0,0 +1,349 @@
+// Package config reconciles the sites collection with a declarative
+// dingdong.yaml (or JSON) file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"gopkg.in/yaml.v3"
+)
+
+var configLog = logging.Component("config")
+
+// DefaultPaths are the files looked for when DINGDONG_CONFIG isn't set, in order
+var DefaultPaths = []string{"dingdong.yaml", "dingdong.yml", "dingdong.json"}
+
+// File is the contents of a config file
+type File struct {
+	Sites []Site `yaml:"sites" json:"sites"`
+}
+
+// Site is a site declared in the config file. Settings left out of the file
+// are left as they are in the database.
+type Site struct {
+	Domain             string   `yaml:"domain" json:"domain"`
+	Name               *string  `yaml:"name" json:"name"`
+	AdditionalDomains  []string `yaml:"additional_domains" json:"additional_domains"`
+	Active             *bool    `yaml:"active" json:"active"`
+	Timezone           *string  `yaml:"timezone" json:"timezone"`
+	RetentionDays      *int     `yaml:"retention_days" json:"retention_days"`
+	Goals              []Goal   `yaml:"goals" json:"goals"`
+	ReferrerBlocklist  []string `yaml:"referrer_blocklist" json:"referrer_blocklist"`
+	ReferrerSpamAction *string  `yaml:"referrer_spam_action" json:"referrer_spam_action"`
+	ExcludedIPs        []string `yaml:"excluded_ips" json:"excluded_ips"`
+	PrivacySignals     *string  `yaml:"privacy_signals" json:"privacy_signals"`
+	PublicWidget       *bool    `yaml:"public_widget" json:"public_widget"`
+}
+
+// Goal is a conversion goal, reached when a visitor views Path
+type Goal struct {
+	Name string `yaml:"name" json:"name"`
+	Path string `yaml:"path" json:"path"`
+}
+
+// Change is one difference between the config file and the database
+type Change struct {
+	Action string // "create", "update" or "release"
+	Domain string
+	Fields []FieldChange
+}
+
+// FieldChange is a single field that differs
+type FieldChange struct {
+	Field string
+	Old   any
+	New   any
+}
+
+// String formats a change for the apply report
+func (c Change) String() string {
+	var b strings.Builder
+	switch c.Action {
+	case "create":
+		fmt.Fprintf(&b, "+ create %s", c.Domain)
+	case "update":
+		fmt.Fprintf(&b, "~ update %s", c.Domain)
+	case "release":
+		fmt.Fprintf(&b, "- release %s (no longer in the config file, left as is)", c.Domain)
+	}
+	for _, f := range c.Fields {
+		if c.Action == "create" {
+			fmt.Fprintf(&b, "\n    %s: %v", f.Field, formatValue(f.New))
+		} else {
+			fmt.Fprintf(&b, "\n    %s: %v -> %v", f.Field, formatValue(f.Old), formatValue(f.New))
+		}
+	}
+	return b.String()
+}
+
+// formatValue prints strings quoted so empty values are visible
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []Goal:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
+
+// Path returns the config file to use: DINGDONG_CONFIG if set, otherwise the
+// first of DefaultPaths that exists, or "" if there is none
+func Path() string {
+	if path := os.Getenv("DINGDONG_CONFIG"); path != "" {
+		return path
+	}
+	for _, path := range DefaultPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Load reads and validates a config file. YAML is a superset of JSON, so
+// both are parsed the same way.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := file.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &file, nil
+}
+
+// validate checks the values the sites collection would reject, so a bad
+// file fails before anything is changed
+func (f *File) validate() error {
+	seen := map[string]bool{}
+	for i := range f.Sites {
+		site := &f.Sites[i]
+		site.Domain = strings.ToLower(strings.TrimSpace(site.Domain))
+		if site.Domain == "" {
+			return fmt.Errorf("sites[%d]: domain is required", i)
+		}
+		if seen[site.Domain] {
+			return fmt.Errorf("sites[%d]: %s is listed twice", i, site.Domain)
+		}
+		seen[site.Domain] = true
+
+		if site.Timezone != nil && *site.Timezone != "" {
+			if _, err := time.LoadLocation(*site.Timezone); err != nil {
+				return fmt.Errorf("%s: unknown timezone %q", site.Domain, *site.Timezone)
+			}
+		}
+		if site.RetentionDays != nil && *site.RetentionDays < 0 {
+			return fmt.Errorf("%s: retention_days must not be negative", site.Domain)
+		}
+		if site.ReferrerSpamAction != nil && !slices.Contains([]string{"", "reject", "flag"}, *site.ReferrerSpamAction) {
+			return fmt.Errorf("%s: referrer_spam_action must be reject or flag", site.Domain)
+		}
+		if site.PrivacySignals != nil && !slices.Contains([]string{"", "ignore", "drop", "anonymize"}, *site.PrivacySignals) {
+			return fmt.Errorf("%s: privacy_signals must be ignore, drop or anonymize", site.Domain)
+		}
+		for _, goal := range site.Goals {
+			if goal.Name == "" || !strings.HasPrefix(goal.Path, "/") {
+				return fmt.Errorf("%s: goals need a name and a path starting with /", site.Domain)
+			}
+		}
+	}
+	return nil
+}
+
+// fields returns the sites collection values the config sets for a site,
+// in a stable order
+func (s Site) fields() []FieldChange {
+	var fields []FieldChange
+	add := func(name string, value any) {
+		fields = append(fields, FieldChange{Field: name, New: value})
+	}
+
+	if s.Name != nil {
+		add("name", *s.Name)
+	}
+	if s.AdditionalDomains != nil {
+		add("additional_domains", strings.Join(s.AdditionalDomains, ","))
+	}
+	if s.Active != nil {
+		add("active", *s.Active)
+	}
+	if s.Timezone != nil {
+		add("timezone", *s.Timezone)
+	}
+	if s.RetentionDays != nil {
+		add("retention_days", *s.RetentionDays)
+	}
+	if s.Goals != nil {
+		add("goals", s.Goals)
+	}
+	if s.ReferrerBlocklist != nil {
+		add("referrer_blocklist", strings.Join(s.ReferrerBlocklist, ","))
+	}
+	if s.ReferrerSpamAction != nil {
+		add("referrer_spam_action", *s.ReferrerSpamAction)
+	}
+	if s.ExcludedIPs != nil {
+		add("excluded_ips", strings.Join(s.ExcludedIPs, ","))
+	}
+	if s.PrivacySignals != nil {
+		add("privacy_signals", *s.PrivacySignals)
+	}
+	if s.PublicWidget != nil {
+		add("public_widget", *s.PublicWidget)
+	}
+	return fields
+}
+
+// currentValue reads a field from a site record in the type the config uses
+func currentValue(site *core.Record, field string) any {
+	switch field {
+	case "active", "public_widget":
+		return site.GetBool(field)
+	case "retention_days":
+		return site.GetInt(field)
+	case "goals":
+		var goals []Goal
+		site.UnmarshalJSONField(field, &goals)
+		if goals == nil {
+			goals = []Goal{}
+		}
+		return goals
+	}
+	return site.GetString(field)
+}
+
+// Apply reconciles the sites collection with the config file and returns the
+// differences. Sites are matched by primary domain. Sites that aren't in the
+// file are never changed, except that ones previously created or updated from
+// the file lose their managed flag. With dryRun nothing is written.
+func Apply(app *pocketbase.PocketBase, file *File, dryRun bool) ([]Change, error) {
+	collection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return nil, err
+	}
+	if collection.Fields.GetByName("managed") == nil {
+		return nil, errors.New("sites collection is missing the config fields, start the server once to migrate it")
+	}
+
+	var changes []Change
+	var records []*core.Record
+	listed := map[string]bool{}
+
+	for _, s := range file.Sites {
+		listed[s.Domain] = true
+
+		site, err := app.FindFirstRecordByFilter("sites", "domain = {:domain}", dbx.Params{"domain": s.Domain})
+		if err != nil {
+			site = core.NewRecord(collection)
+			site.Set("domain", s.Domain)
+			site.Set("name", s.Domain)
+			site.Set("active", true)
+
+			change := Change{Action: "create", Domain: s.Domain}
+			for _, f := range s.fields() {
+				site.Set(f.Field, f.New)
+				change.Fields = append(change.Fields, f)
+			}
+			site.Set("managed", true)
+			changes = append(changes, change)
+			records = append(records, site)
+			continue
+		}
+
+		change := Change{Action: "update", Domain: s.Domain}
+		for _, f := range s.fields() {
+			f.Old = currentValue(site, f.Field)
+			if reflect.DeepEqual(f.Old, f.New) {
+				continue
+			}
+			site.Set(f.Field, f.New)
+			change.Fields = append(change.Fields, f)
+		}
+		if !site.GetBool("managed") {
+			change.Fields = append(change.Fields, FieldChange{Field: "managed", Old: false, New: true})
+			site.Set("managed", true)
+		}
+		if len(change.Fields) > 0 {
+			changes = append(changes, change)
+			records = append(records, site)
+		}
+	}
+
+	managed, err := app.FindRecordsByFilter("sites", "managed = true", "domain", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, site := range managed {
+		if listed[site.GetString("domain")] {
+			continue
+		}
+		site.Set("managed", false)
+		changes = append(changes, Change{Action: "release", Domain: site.GetString("domain")})
+		records = append(records, site)
+	}
+
+	if dryRun || len(records) == 0 {
+		return changes, nil
+	}
+
+	err = app.RunInTransaction(func(txApp core.App) error {
+		for _, site := range records {
+			if err := txApp.Save(site); err != nil {
+				return fmt.Errorf("%s: %w", site.GetString("domain"), err)
+			}
+		}
+		return nil
+	})
+
+	return changes, err
+}
+
+// Register applies the config file, if there is one, each time the server
+// starts. It must be registered after the migrations.
+func Register(app *pocketbase.PocketBase) {
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		path := Path()
+		if path == "" {
+			return e.Next()
+		}
+
+		file, err := Load(path)
+		if err != nil {
+			return err
+		}
+
+		changes, err := Apply(app, file, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		for _, change := range changes {
+			configLog.Info("Site "+change.Action+"d", "domain", change.Domain, "change", change.String())
+		}
+		configLog.Info("Applied config file", "path", path, "sites", len(file.Sites), "changes", len(changes))
+
+		return e.Next()
+	})
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Access log formats accepted by ImportAccessLog
+const (
+	AccessLogCombined  = "combined"
+	AccessLogNginxJSON = "nginx-json"
+	AccessLogCaddy     = "caddy"
+)
+
+// AccessLogFormats lists the supported access log formats
+var AccessLogFormats = []string{AccessLogCombined, AccessLogNginxJSON, AccessLogCaddy}
+
+// accessLogBatchSize is how many lines are imported per transaction
+const accessLogBatchSize = 1000
+
+// accessLogAssetExtensions are file types that are never counted as pageviews
+var accessLogAssetExtensions = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true, ".json": true, ".xml": true, ".txt": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".pdf": true, ".zip": true, ".gz": true, ".wasm": true,
+}
+
+// AccessLogEntry is a single request parsed from an access log
+type AccessLogEntry struct {
+	Time      time.Time
+	IP        string
+	Method    string
+	Host      string // empty if the format doesn't log it
+	URI       string
+	Status    int
+	Referrer  string
+	UserAgent string
+}
+
+// AccessLogResult counts what happened to the lines of an access log
+type AccessLogResult struct {
+	Lines      int
+	Imported   int
+	Duplicates int // already imported by an earlier run
+	Filtered   int // assets, bots, errors, other hosts, excluded IPs and spam
+	Invalid    int
+}
+
+var combinedLogPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) \S+(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+// combinedLogTimeLayout is the timestamp layout of the Common and Combined Log Formats
+const combinedLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// ParseAccessLogLine parses a line in one of the AccessLogFormats
+func ParseAccessLogLine(format, line string) (AccessLogEntry, error) {
+	switch format {
+	case AccessLogCombined:
+		return parseCombinedLogLine(line)
+	case AccessLogNginxJSON:
+		return parseNginxJSONLogLine(line)
+	case AccessLogCaddy:
+		return parseCaddyLogLine(line)
+	}
+	return AccessLogEntry{}, fmt.Errorf("unsupported access log format %q", format)
+}
+
+// parseCombinedLogLine parses Apache/nginx Combined (or Common) Log Format
+func parseCombinedLogLine(line string) (AccessLogEntry, error) {
+	m := combinedLogPattern.FindStringSubmatch(line)
+	if m == nil {
+		return AccessLogEntry{}, errors.New("not a combined log line")
+	}
+
+	t, err := time.Parse(combinedLogTimeLayout, m[2])
+	if err != nil {
+		return AccessLogEntry{}, err
+	}
+
+	entry := AccessLogEntry{
+		Time:      t,
+		IP:        m[1],
+		Referrer:  unescapeLogField(m[5]),
+		UserAgent: unescapeLogField(m[6]),
+	}
+	entry.Status, _ = strconv.Atoi(m[4])
+	entry.Method, entry.URI = splitRequestLine(unescapeLogField(m[3]))
+
+	return entry, nil
+}
+
+// parseNginxJSONLogLine parses an nginx log_format with escape=json, using
+// nginx's variable names as keys (time_iso8601 or time_local, remote_addr,
+// request or request_method and request_uri, status, http_referer,
+// http_user_agent and optionally host)
+func parseNginxJSONLogLine(line string) (AccessLogEntry, error) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return AccessLogEntry{}, err
+	}
+
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			switch v := fields[key].(type) {
+			case string:
+				if v != "" {
+					return v
+				}
+			case float64:
+				return strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		return ""
+	}
+
+	entry := AccessLogEntry{
+		IP:        get("remote_addr", "client_ip"),
+		Method:    get("request_method", "method"),
+		Host:      get("host", "http_host", "server_name"),
+		URI:       get("request_uri", "uri"),
+		Referrer:  get("http_referer", "referer", "referrer"),
+		UserAgent: get("http_user_agent", "user_agent"),
+	}
+	entry.Status, _ = strconv.Atoi(get("status"))
+	if entry.Referrer == "-" {
+		entry.Referrer = ""
+	}
+	if entry.Method == "" || entry.URI == "" {
+		entry.Method, entry.URI = splitRequestLine(get("request"))
+	}
+
+	var err error
+	if v := get("time_iso8601"); v != "" {
+		entry.Time, err = time.Parse(time.RFC3339, v)
+	} else if v := get("time_local"); v != "" {
+		entry.Time, err = time.Parse(combinedLogTimeLayout, v)
+	} else if v := get("msec"); v != "" {
+		var secs float64
+		secs, err = strconv.ParseFloat(v, 64)
+		entry.Time = time.UnixMilli(int64(secs * 1000))
+	} else {
+		err = errors.New("missing time_iso8601, time_local or msec")
+	}
+	if err != nil {
+		return AccessLogEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// caddyLogLine is the subset of Caddy's JSON access log that is imported
+type caddyLogLine struct {
+	TS      float64 `json:"ts"`
+	Status  int     `json:"status"`
+	Request struct {
+		RemoteIP string              `json:"remote_ip"`
+		ClientIP string              `json:"client_ip"`
+		Method   string              `json:"method"`
+		Host     string              `json:"host"`
+		URI      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+	} `json:"request"`
+}
+
+// parseCaddyLogLine parses Caddy's default JSON access log
+func parseCaddyLogLine(line string) (AccessLogEntry, error) {
+	var l caddyLogLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil {
+		return AccessLogEntry{}, err
+	}
+	if l.TS == 0 || l.Request.Method == "" {
+		return AccessLogEntry{}, errors.New("not a caddy access log line")
+	}
+
+	header := func(name string) string {
+		if values := l.Request.Headers[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	// client_ip honors trusted proxies; older versions only log remote_ip
+	ip := l.Request.ClientIP
+	if ip == "" {
+		ip = l.Request.RemoteIP
+	}
+
+	return AccessLogEntry{
+		Time:      time.UnixMilli(int64(l.TS * 1000)),
+		IP:        ip,
+		Method:    l.Request.Method,
+		Host:      l.Request.Host,
+		URI:       l.Request.URI,
+		Status:    l.Status,
+		Referrer:  header("Referer"),
+		UserAgent: header("User-Agent"),
+	}, nil
+}
+
+// splitRequestLine splits "GET /path HTTP/1.1" into method and URI
+func splitRequestLine(request string) (string, string) {
+	parts := strings.Fields(request)
+	if len(parts) < 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// unescapeLogField undoes the escaping Apache (\") and nginx (\x22) apply
+// to quoted fields, and treats "-" as empty
+func unescapeLogField(v string) string {
+	if v == "-" {
+		return ""
+	}
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	if unquoted, err := strconv.Unquote(`"` + v + `"`); err == nil {
+		return unquoted
+	}
+	return v
+}
+
+// isPageRequest reports whether a log entry looks like a successful page view
+// by a person, rather than an asset, API call, error or bot
+func isPageRequest(entry AccessLogEntry) bool {
+	if entry.Method != "GET" || entry.Status < 200 || entry.Status > 299 {
+		return false
+	}
+	if entry.UserAgent == "" || isBotUserAgent(strings.ToLower(entry.UserAgent)) {
+		return false
+	}
+
+	p, _, _ := strings.Cut(entry.URI, "?")
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/.well-known/") {
+		return false
+	}
+	return !accessLogAssetExtensions[strings.ToLower(path.Ext(p))]
+}
+
+// siteHasDomain reports whether host is the site's domain or one of its additional domains
+func siteHasDomain(site *core.Record, host string) bool {
+	host = strings.ToLower(ExtractDomain(host))
+	if host == strings.ToLower(site.GetString("domain")) {
+		return true
+	}
+	for _, d := range strings.Split(site.GetString("additional_domains"), ",") {
+		if strings.ToLower(strings.TrimSpace(d)) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportAccessLog reads an access log and saves every page request for the
+// site as a pageview with its original timestamp. Each line is stored with a
+// hash of its contents, so importing the same log again skips it.
+func ImportAccessLog(app *pocketbase.PocketBase, site *core.Record, format string, r io.Reader) (AccessLogResult, error) {
+	var result AccessLogResult
+
+	collection, err := app.FindCollectionByNameOrId("pageviews")
+	if err != nil {
+		return result, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	batch := make([]string, 0, accessLogBatchSize)
+	flush := func() error {
+		err := app.RunInTransaction(func(txApp core.App) error {
+			for _, line := range batch {
+				if err := importAccessLogLine(txApp, collection, site, format, line, &result); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		result.Lines++
+
+		batch = append(batch, line)
+		if len(batch) == accessLogBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	// The imported pageviews are in hours that were already rolled up
+	if result.Imported > 0 {
+		return result, RebuildHourly(app, site.Id, time.Time{}, time.Time{})
+	}
+	return result, nil
+}
+
+// importAccessLogLine parses, filters and saves a single access log line
+func importAccessLogLine(txApp core.App, collection *core.Collection, site *core.Record, format, line string, result *AccessLogResult) error {
+	entry, err := ParseAccessLogLine(format, line)
+	// Values longer than the pageviews fields allow would fail validation
+	if err != nil || len(entry.URI) > 2048 || len(entry.Referrer) > 2048 || len(entry.UserAgent) > 1024 {
+		result.Invalid++
+		return nil
+	}
+
+	if !isPageRequest(entry) ||
+		(entry.Host != "" && !siteHasDomain(site, entry.Host)) ||
+		IsExcludedIP(entry.IP, site.GetString("excluded_ips")) {
+		result.Filtered++
+		return nil
+	}
+
+	isSpam := IsReferrerSpam(entry.Referrer, site.GetString("referrer_blocklist"))
+	if isSpam && site.GetString("referrer_spam_action") != "flag" {
+		result.Filtered++
+		return nil
+	}
+
+	// The site is part of the hash so one log can be imported into several sites
+	sum := sha256.Sum256([]byte(site.Id + "\n" + line))
+	lineHash := hex.EncodeToString(sum[:])
+
+	var existing struct {
+		Count int `db:"count"`
+	}
+	err = txApp.DB().
+		NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE import_hash = {:hash}").
+		Bind(dbx.Params{"hash": lineHash}).
+		One(&existing)
+	if err != nil {
+		return err
+	}
+	if existing.Count > 0 {
+		result.Duplicates++
+		return nil
+	}
+
+	created, err := types.ParseDateTime(entry.Time.UTC())
+	if err != nil {
+		return err
+	}
+
+	ip := entry.IP
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("site", site.Id)
+	record.Set("path", entry.URI)
+	record.Set("referrer", entry.Referrer)
+	record.Set("referrer_source", referrerHost(entry.Referrer))
+	record.Set("user_agent", entry.UserAgent)
+	record.Set("ip_hash", hashIP(ip))
+	record.Set("spam", isSpam)
+	record.Set("import_hash", lineHash)
+	// Keep the original request time instead of the import time
+	record.SetRaw("created", created)
+
+	uaInfo := ParseUserAgent(entry.UserAgent)
+	record.Set("browser", uaInfo.Browser)
+	record.Set("os", uaInfo.OS)
+	record.Set("device", uaInfo.Device)
+
+	utm := ParseUTM(entry.URI)
+	record.Set("utm_source", utm.Source)
+	record.Set("utm_medium", utm.Medium)
+	record.Set("utm_campaign", utm.Campaign)
+
+	if err := txApp.Save(record); err != nil {
+		return err
+	}
+
+	result.Imported++
+	return nil
+}
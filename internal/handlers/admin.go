@@ -1,12 +1,18 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
+	"github.com/abigpotostew/dingdong/internal/logging"
+
 	"github.com/pocketbase/pocketbase/core"
 )
 
+var adminLog = logging.Component("admin")
+
 // DashboardData contains data for the main dashboard view
 type DashboardData struct {
 	Sites          []SiteSummary
@@ -34,25 +40,75 @@ type SiteStatsData struct {
 	TotalViews     int
 	TodayViews     int
 	UniqueVisitors int
+	LiveVisitors   int
+	OptedOut       int
+	OptedOutShare  string
 	TrackerURL     string
+	PublicWidget   bool
+	Shared         bool // read-only share link view, without live or per-pageview data
+	Imported       []ImportSummary
+	Breakdowns     []BreakdownTable
+	Filters        []ActiveFilter
+	FilterOptions  FilterOptions
 }
 
 // PageStats represents stats for a single page
 type PageStats struct {
-	Path  string
-	Views int
+	Path      string
+	Views     int
+	FilterURL string
 }
 
 // ReferrerStats represents stats for a referrer
 type ReferrerStats struct {
-	Referrer string
-	Views    int
+	Referrer  string
+	Views     int
+	FilterURL string
+}
+
+// BreakdownTable is a top list of the values of one property
+type BreakdownTable struct {
+	Title string
+	Rows  []BreakdownRow
+}
+
+// BreakdownRow is a value of a breakdown, with a link that filters by it
+type BreakdownRow struct {
+	Value     string
+	Views     int
+	FilterURL string
+}
+
+// ActiveFilter is a filter applied to the page, with a link that removes it
+type ActiveFilter struct {
+	Filter
+	RemoveURL string
+}
+
+// FilterOptions lists the choices of the add filter form
+type FilterOptions struct {
+	Properties []string
+	Ops        []string
+}
+
+// siteBreakdowns are the top lists shown below top pages and referrers
+var siteBreakdowns = []struct {
+	title    string
+	property string
+}{
+	{"Browsers", "browser"},
+	{"Operating Systems", "os"},
+	{"Devices", "device"},
+	{"Countries", "country"},
+	{"UTM Sources", "utm_source"},
+	{"UTM Campaigns", "utm_campaign"},
 }
 
 // DailyStats represents daily pageview counts
 type DailyStats struct {
-	Date  string
-	Views int
+	Date     string
+	Views    int
+	Imported bool
 }
 
 // PageviewRecord represents a single pageview for display
@@ -63,9 +119,9 @@ type PageviewRecord struct {
 	UserAgent string
 }
 
-// HandleDashboard renders the main dashboard showing all sites
+// HandleDashboard renders the main dashboard showing the sites the user may see
 func (h *Handlers) HandleDashboard(e *core.RequestEvent) error {
-	sites, err := h.app.FindRecordsByFilter("sites", "1=1", "-created", 100, 0)
+	sites, err := VisibleSites(h.app, e.Auth)
 	if err != nil {
 		sites = []*core.Record{}
 	}
@@ -76,39 +132,22 @@ func (h *Handlers) HandleDashboard(e *core.RequestEvent) error {
 		TrackerURL: GetPublicURL(e),
 	}
 
-	today := time.Now().UTC().Truncate(24 * time.Hour).Format("2006-01-02 15:04:05")
+	// One grouped query for every site instead of counting each one
+	totals, err := QueryPageviewTotals(h.app, "", time.Now().UTC().Truncate(24*time.Hour))
+	if err != nil {
+		adminLog.ErrorContext(e.Request.Context(), "Failed to load pageview totals", "error", err)
+	}
 
 	for _, site := range sites {
-		summary := SiteSummary{
-			ID:     site.Id,
-			Name:   site.GetString("name"),
-			Domain: site.GetString("domain"),
-		}
-
-		var totalCount struct {
-			Count int `db:"count"`
-		}
-		err := h.app.DB().
-			NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE site = {:siteId}").
-			Bind(map[string]any{"siteId": site.Id}).
-			One(&totalCount)
-		if err == nil {
-			summary.Pageviews = totalCount.Count
-			data.TotalPageviews += totalCount.Count
-		}
-
-		var todayCount struct {
-			Count int `db:"count"`
-		}
-		err = h.app.DB().
-			NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE site = {:siteId} AND created >= {:today}").
-			Bind(map[string]any{"siteId": site.Id, "today": today}).
-			One(&todayCount)
-		if err == nil {
-			summary.TodayViews = todayCount.Count
-		}
-
-		data.Sites = append(data.Sites, summary)
+		total := totals[site.Id]
+		data.Sites = append(data.Sites, SiteSummary{
+			ID:         site.Id,
+			Name:       site.GetString("name"),
+			Domain:     site.GetString("domain"),
+			Pageviews:  total.Total,
+			TodayViews: total.Since,
+		})
+		data.TotalPageviews += total.Total
 	}
 
 	return h.renderTemplate(e, "dashboard.html", data)
@@ -124,122 +163,164 @@ func (h *Handlers) HandleSiteStats(e *core.RequestEvent) error {
 	siteId := e.Request.PathValue("siteId")
 
 	site, err := h.app.FindRecordById("sites", siteId)
-	if err != nil {
+	if err != nil || !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
 		return e.JSON(http.StatusNotFound, map[string]string{
 			"error": "Site not found",
 		})
 	}
 
+	filters, err := ParseFilters(e.Request.URL.Query())
+	if err != nil {
+		return writeAPIError(e, badRequest(err.Error()))
+	}
+
+	data := h.siteStatsData(site, filters)
+	data.TrackerURL = GetPublicURL(e)
+	data.LiveVisitors = h.live.ActiveVisitors(siteId)
+	data.PublicWidget = site.GetBool("public_widget")
+
+	recentViews, err := QueryRecentPageviews(h.app, StatsQuery{SiteID: siteId, Filters: filters}, 20)
+	if err == nil {
+		data.RecentViews = recentViews
+	}
+
+	return h.renderTemplate(e, "site_stats.html", data)
+}
+
+// siteStatsData loads the aggregate stats shown on a site's stats page, all
+// narrowed by the filters. It leaves out anything tied to individual
+// pageviews so share links can reuse it.
+func (h *Handlers) siteStatsData(site *core.Record, filters []Filter) SiteStatsData {
+	siteId := site.Id
 	data := SiteStatsData{
 		Site: SiteSummary{
 			ID:     site.Id,
 			Name:   site.GetString("name"),
 			Domain: site.GetString("domain"),
 		},
-		TrackerURL: GetPublicURL(e),
+		FilterOptions: FilterOptions{Properties: BreakdownProperties(), Ops: filterOps},
 	}
 
-	today := time.Now().UTC().Truncate(24 * time.Hour).Format("2006-01-02 15:04:05")
-
-	var totalCount struct {
-		Count int `db:"count"`
+	for i, f := range filters {
+		data.Filters = append(data.Filters, ActiveFilter{
+			Filter:    f,
+			RemoveURL: FilterQuery(slices.Delete(slices.Clone(filters), i, i+1)),
+		})
 	}
-	err = h.app.DB().
-		NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE site = {:siteId}").
-		Bind(map[string]any{"siteId": siteId}).
-		One(&totalCount)
-	if err == nil {
-		data.TotalViews = totalCount.Count
+	filterURL := func(property, value string) string {
+		return FilterQuery(WithFilter(filters, Filter{Property: property, Op: FilterIs, Value: value}))
 	}
 
-	var todayCount struct {
-		Count int `db:"count"`
-	}
-	err = h.app.DB().
-		NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE site = {:siteId} AND created >= {:today}").
-		Bind(map[string]any{"siteId": siteId, "today": today}).
-		One(&todayCount)
-	if err == nil {
-		data.TodayViews = todayCount.Count
-	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	allTime := StatsQuery{SiteID: siteId, Filters: filters}
 
-	var uniqueCount struct {
-		Count int `db:"count"`
-	}
-	err = h.app.DB().
-		NewQuery("SELECT COUNT(DISTINCT ip_hash) as count FROM pageviews WHERE site = {:siteId} AND ip_hash != ''").
-		Bind(map[string]any{"siteId": siteId}).
-		One(&uniqueCount)
+	// Unique visitors can't be summed from the hourly counters, so they're
+	// counted from pageviews, as are the top lists
+	total, err := QueryAggregate(h.app, allTime)
 	if err == nil {
-		data.UniqueVisitors = uniqueCount.Count
+		data.UniqueVisitors = total.Visitors
 	}
 
-	var topPages []struct {
-		Path  string `db:"path"`
-		Views int    `db:"views"`
+	if len(filters) == 0 {
+		h.loadSiteTotals(&data, today)
+	} else {
+		// The hourly counters and imported stats have no properties to
+		// filter, so filtered totals and days are counted from pageviews
+		data.TotalViews = total.Pageviews
+		todayStats, err := QueryAggregate(h.app, StatsQuery{SiteID: siteId, From: today, Filters: filters})
+		if err == nil {
+			data.TodayViews = todayStats.Pageviews
+		}
 	}
-	err = h.app.DB().
-		NewQuery("SELECT path, COUNT(*) as views FROM pageviews WHERE site = {:siteId} GROUP BY path ORDER BY views DESC LIMIT 10").
-		Bind(map[string]any{"siteId": siteId}).
-		All(&topPages)
+
+	topPages, err := QueryBreakdown(h.app, allTime, "path", 10, 0)
 	if err == nil {
 		data.TopPages = make([]PageStats, len(topPages))
 		for i, p := range topPages {
-			data.TopPages[i] = PageStats{Path: p.Path, Views: p.Views}
+			data.TopPages[i] = PageStats{Path: p.Value, Views: p.Pageviews, FilterURL: filterURL("path", p.Value)}
 		}
 	}
 
-	var topReferrers []struct {
-		Referrer string `db:"referrer"`
-		Views    int    `db:"views"`
-	}
-	err = h.app.DB().
-		NewQuery("SELECT referrer, COUNT(*) as views FROM pageviews WHERE site = {:siteId} AND referrer != '' GROUP BY referrer ORDER BY views DESC LIMIT 10").
-		Bind(map[string]any{"siteId": siteId}).
-		All(&topReferrers)
+	// Referrers are listed by site, as full referrer URLs rarely repeat
+	topReferrers, err := QueryBreakdown(h.app, allTime, "referrer_source", 10, 0)
 	if err == nil {
 		data.TopReferrers = make([]ReferrerStats, len(topReferrers))
 		for i, r := range topReferrers {
-			data.TopReferrers[i] = ReferrerStats{Referrer: r.Referrer, Views: r.Views}
+			data.TopReferrers[i] = ReferrerStats{Referrer: r.Value, Views: r.Pageviews, FilterURL: filterURL("referrer_source", r.Value)}
 		}
 	}
 
-	var dailyStats []struct {
-		Date  string `db:"date"`
-		Views int    `db:"views"`
+	for _, b := range siteBreakdowns {
+		items, err := QueryBreakdown(h.app, allTime, b.property, 10, 0)
+		if err != nil {
+			continue
+		}
+		table := BreakdownTable{Title: b.title, Rows: make([]BreakdownRow, len(items))}
+		for i, item := range items {
+			table.Rows[i] = BreakdownRow{Value: item.Value, Views: item.Pageviews, FilterURL: filterURL(b.property, item.Value)}
+		}
+		data.Breakdowns = append(data.Breakdowns, table)
+	}
+
+	// Last 30 days, most recent first
+	recent := StatsQuery{
+		SiteID:  siteId,
+		From:    today.AddDate(0, 0, -29),
+		To:      today.AddDate(0, 0, 1),
+		Filters: filters,
+	}
+	var dailyStats []TimeseriesPoint
+	if len(filters) == 0 {
+		dailyStats, err = QueryDailyPageviews(h.app, recent)
+	} else {
+		dailyStats, err = QueryTimeseries(h.app, recent, "day")
 	}
-	err = h.app.DB().
-		NewQuery("SELECT DATE(created) as date, COUNT(*) as views FROM pageviews WHERE site = {:siteId} GROUP BY DATE(created) ORDER BY date DESC LIMIT 30").
-		Bind(map[string]any{"siteId": siteId}).
-		All(&dailyStats)
 	if err == nil {
 		data.DailyStats = make([]DailyStats, len(dailyStats))
 		for i, d := range dailyStats {
-			data.DailyStats[i] = DailyStats{Date: d.Date, Views: d.Views}
+			data.DailyStats[len(dailyStats)-1-i] = DailyStats{Date: d.Date, Views: d.Pageviews, Imported: d.Imported}
 		}
 	}
 
-	recentPageviews, err := h.app.FindRecordsByFilter(
-		"pageviews",
-		"site = {:siteId}",
-		"-created",
-		20,
-		0,
-		map[string]any{"siteId": siteId},
-	)
+	return data
+}
+
+// loadSiteTotals adds the unfiltered totals, opt-out share and imported
+// history of a site to its stats page. Totals come from the hourly counters.
+func (h *Handlers) loadSiteTotals(data *SiteStatsData, today time.Time) {
+	siteId := data.Site.ID
+
+	// Tracked pageviews only, as imported history has no opt-out signal
+	tracked := 0
+	totals, err := QueryPageviewTotals(h.app, siteId, today)
+	if err == nil {
+		tracked = totals[siteId].Total
+		data.TotalViews = tracked
+		data.TodayViews = totals[siteId].Since
+	}
+	if imported, err := ImportedPageviews(h.app, siteId); err == nil {
+		data.TotalViews += imported
+	}
+
+	// Share of pings that carried a DNT/GPC signal (dropped ones never reach pageviews)
+	var optOuts struct {
+		Dropped    int `db:"dropped"`
+		Anonymized int `db:"anonymized"`
+	}
+	err = h.app.DB().
+		NewQuery("SELECT COALESCE(SUM(dropped), 0) as dropped, COALESCE(SUM(anonymized), 0) as anonymized FROM privacy_optouts WHERE site = {:siteId}").
+		Bind(map[string]any{"siteId": siteId}).
+		One(&optOuts)
 	if err == nil {
-		data.RecentViews = make([]PageviewRecord, len(recentPageviews))
-		for i, pv := range recentPageviews {
-			data.RecentViews[i] = PageviewRecord{
-				Path:      pv.GetString("path"),
-				Referrer:  pv.GetString("referrer"),
-				CreatedAt: pv.GetDateTime("created").Time(),
-				UserAgent: pv.GetString("user_agent"),
-			}
+		data.OptedOut = optOuts.Dropped + optOuts.Anonymized
+		if total := tracked + optOuts.Dropped; total > 0 {
+			data.OptedOutShare = fmt.Sprintf("%.1f", float64(data.OptedOut)*100/float64(total))
 		}
 	}
 
-	return h.renderTemplate(e, "site_stats.html", data)
+	if imported, err := ImportSummaries(h.app, siteId); err == nil {
+		data.Imported = imported
+	}
 }
 
 // HandleAdmin renders the admin management page
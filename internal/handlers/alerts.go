@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+var alertsLog = logging.Component("alerts")
+
+// Alert rule kinds
+const (
+	AlertSpike   = "spike"   // more than threshold pageviews in the last hour
+	AlertDrop    = "drop"    // last hour below threshold percent of the trailing average
+	AlertSilence = "silence" // no pageviews for threshold hours
+)
+
+// AlertKinds lists every alert rule kind
+var AlertKinds = []string{AlertSpike, AlertDrop, AlertSilence}
+
+// alertCooldown is how long a rule waits after triggering before it can
+// trigger again, so a value hovering around the threshold doesn't flap
+const alertCooldown = time.Hour
+
+// alertDropMinBaseline is the trailing hourly average below which drop rules
+// aren't evaluated, as a few missing pageviews on a quiet site isn't a drop
+const alertDropMinBaseline = 5
+
+// alertDropDays is how many previous days the drop baseline averages
+const alertDropDays = 7
+
+// alertHistoryLimit is how many alert events the history endpoint returns
+const alertHistoryLimit = 50
+
+// AlertRule is an alert rule as returned by the alert endpoints
+type AlertRule struct {
+	ID            string  `json:"id"`
+	Kind          string  `json:"kind"`
+	Threshold     float64 `json:"threshold"`
+	Email         string  `json:"email"`
+	WebhookURL    string  `json:"webhook_url"`
+	Active        bool    `json:"active"`
+	Firing        bool    `json:"firing"`
+	LastTriggered string  `json:"last_triggered"`
+}
+
+// AlertRuleRequest is the body of the alert rule create and update endpoints
+type AlertRuleRequest struct {
+	Kind       string  `json:"kind"`
+	Threshold  float64 `json:"threshold"`
+	Email      string  `json:"email"`
+	WebhookURL string  `json:"webhook_url"`
+	Active     *bool   `json:"active"` // defaults to true
+}
+
+// AlertEvent is a triggered or resolved alert as returned by the history endpoint
+type AlertEvent struct {
+	ID      string  `json:"id"`
+	RuleID  string  `json:"rule_id"`
+	Status  string  `json:"status"`
+	Message string  `json:"message"`
+	Value   float64 `json:"value"`
+	Error   string  `json:"error"`
+	Created string  `json:"created"`
+}
+
+// AlertWebhookPayload is the JSON body POSTed to an alert's webhook URL
+type AlertWebhookPayload struct {
+	RuleID    string  `json:"rule_id"`
+	SiteID    string  `json:"site_id"`
+	Domain    string  `json:"domain"`
+	Kind      string  `json:"kind"`
+	Status    string  `json:"status"`
+	Message   string  `json:"message"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Time      string  `json:"time"`
+}
+
+// countPageviews counts a site's non-spam pageviews in [from, to)
+func countPageviews(app *pocketbase.PocketBase, siteId string, from, to time.Time) (int, error) {
+	var count int
+	err := app.DB().
+		NewQuery("SELECT COUNT(*) FROM pageviews WHERE site = {:site} AND spam = FALSE AND created >= {:from} AND created < {:to}").
+		Bind(dbx.Params{
+			"site": siteId,
+			"from": from.UTC().Format(dbTimeLayout),
+			"to":   to.UTC().Format(dbTimeLayout),
+		}).
+		Row(&count)
+	return count, err
+}
+
+// checkAlertRule evaluates a rule at now and returns the value it compared,
+// whether the alert condition holds and a message describing it
+func checkAlertRule(app *pocketbase.PocketBase, rule *core.Record, domain string, now time.Time) (float64, bool, string, error) {
+	siteId := rule.GetString("site")
+	threshold := rule.GetFloat("threshold")
+
+	switch rule.GetString("kind") {
+	case AlertSpike:
+		count, err := countPageviews(app, siteId, now.Add(-time.Hour), now)
+		if err != nil {
+			return 0, false, "", err
+		}
+		message := fmt.Sprintf("%s had %d pageviews in the last hour (alert above %g)", domain, count, threshold)
+		return float64(count), float64(count) > threshold, message, nil
+
+	case AlertDrop:
+		// Compare with the same hour on previous days, so quiet nights aren't drops
+		count, err := countPageviews(app, siteId, now.Add(-time.Hour), now)
+		if err != nil {
+			return 0, false, "", err
+		}
+		total := 0
+		for day := 1; day <= alertDropDays; day++ {
+			end := now.AddDate(0, 0, -day)
+			previous, err := countPageviews(app, siteId, end.Add(-time.Hour), end)
+			if err != nil {
+				return 0, false, "", err
+			}
+			total += previous
+		}
+		baseline := float64(total) / alertDropDays
+		if baseline < alertDropMinBaseline {
+			return 0, false, "", nil
+		}
+		percent := float64(count) * 100 / baseline
+		message := fmt.Sprintf("%s had %d pageviews in the last hour, %.0f%% of the usual %.0f (alert below %g%%)", domain, count, percent, baseline, threshold)
+		return percent, percent < threshold, message, nil
+
+	case AlertSilence:
+		var last string
+		err := app.DB().
+			NewQuery("SELECT COALESCE(MAX(created), '') FROM pageviews WHERE site = {:site} AND spam = FALSE").
+			Bind(dbx.Params{"site": siteId}).
+			Row(&last)
+		if err != nil || last == "" {
+			// Sites that never received a pageview aren't broken, just new
+			return 0, false, "", err
+		}
+		lastTime, err := time.Parse(dbTimeLayout, last)
+		if err != nil {
+			return 0, false, "", err
+		}
+		hours := now.Sub(lastTime).Hours()
+		if hours < threshold {
+			message := fmt.Sprintf("%s is receiving pageviews again, the last one %.0f minutes ago", domain, now.Sub(lastTime).Minutes())
+			return hours, false, message, nil
+		}
+		message := fmt.Sprintf("%s has had no pageviews for %.1f hours (alert after %g), is the tracker still installed?", domain, hours, threshold)
+		return hours, true, message, nil
+	}
+
+	return 0, false, "", fmt.Errorf("unknown alert kind %q", rule.GetString("kind"))
+}
+
+// EvaluateAlerts checks every active alert rule. A rule notifies once when its
+// condition starts holding and once when it stops, and never triggers again
+// within alertCooldown of the last time.
+func EvaluateAlerts(app *pocketbase.PocketBase) {
+	rules, err := app.FindRecordsByFilter("alert_rules", "active = true", "site", 0, 0)
+	if err != nil {
+		alertsLog.Error("Failed to load alert rules", "error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, rule := range rules {
+		site, err := app.FindRecordById("sites", rule.GetString("site"))
+		if err != nil || !site.GetBool("active") {
+			continue
+		}
+
+		value, triggered, message, err := checkAlertRule(app, rule, site.GetString("domain"), now)
+		if err != nil {
+			alertsLog.Error("Failed to evaluate rule", "rule", rule.Id, "error", err)
+			continue
+		}
+
+		firing := rule.GetBool("firing")
+		switch {
+		case triggered && !firing:
+			if last := rule.GetDateTime("last_triggered"); !last.IsZero() && now.Sub(last.Time()) < alertCooldown {
+				continue
+			}
+			rule.Set("firing", true)
+			rule.Set("last_triggered", now)
+			notifyAlert(app, rule, site, "triggered", message, value, now)
+		case !triggered && firing:
+			rule.Set("firing", false)
+			if message == "" {
+				message = site.GetString("domain") + " is back to normal"
+			}
+			notifyAlert(app, rule, site, "resolved", message, value, now)
+		default:
+			continue
+		}
+
+		if err := app.Save(rule); err != nil {
+			alertsLog.Error("Failed to save rule", "rule", rule.Id, "error", err)
+		}
+	}
+}
+
+// notifyAlert delivers an alert to the rule's email and webhook and records it
+// in alert_events together with any delivery errors
+func notifyAlert(app *pocketbase.PocketBase, rule, site *core.Record, status, message string, value float64, now time.Time) {
+	alertsLog.Info(message, "rule", rule.Id, "site", site.Id, "status", status, "value", value)
+
+	var errs []string
+	if email := rule.GetString("email"); email != "" {
+		settings := app.Settings()
+		err := app.NewMailClient().Send(&mailer.Message{
+			From:    mail.Address{Name: settings.Meta.SenderName, Address: settings.Meta.SenderAddress},
+			To:      []mail.Address{{Address: email}},
+			Subject: fmt.Sprintf("[DingDong] %s alert %s for %s", rule.GetString("kind"), status, site.GetString("domain")),
+			Text:    message + "\n\n" + reportBaseURL(app) + "/sites/" + site.Id + "\n",
+		})
+		if err != nil {
+			errs = append(errs, "email: "+err.Error())
+		}
+	}
+
+	if webhookURL := rule.GetString("webhook_url"); webhookURL != "" {
+		err := postAlertWebhook(webhookURL, AlertWebhookPayload{
+			RuleID:    rule.Id,
+			SiteID:    site.Id,
+			Domain:    site.GetString("domain"),
+			Kind:      rule.GetString("kind"),
+			Status:    status,
+			Message:   message,
+			Value:     value,
+			Threshold: rule.GetFloat("threshold"),
+			Time:      now.Format(time.RFC3339),
+		})
+		if err != nil {
+			errs = append(errs, "webhook: "+err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		alertsLog.Warn("Failed to deliver alert", "rule", rule.Id, "error", strings.Join(errs, "; "))
+	}
+
+	collection, err := app.FindCollectionByNameOrId("alert_events")
+	if err != nil {
+		alertsLog.Error("Failed to record alert", "rule", rule.Id, "error", err)
+		return
+	}
+
+	event := core.NewRecord(collection)
+	event.Set("rule", rule.Id)
+	event.Set("site", site.Id)
+	event.Set("status", status)
+	event.Set("message", message)
+	event.Set("value", value)
+	event.Set("error", strings.Join(errs, "; "))
+	if err := app.Save(event); err != nil {
+		alertsLog.Error("Failed to record alert", "rule", rule.Id, "error", err)
+	}
+}
+
+// postAlertWebhook POSTs an alert as JSON and fails on non-2xx responses
+func postAlertWebhook(webhookURL string, payload AlertWebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := outboundClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", webhookURL, resp.Status)
+	}
+	return nil
+}
+
+// parseAlertRuleRequest decodes and validates an alert rule body
+func parseAlertRuleRequest(e *core.RequestEvent) (AlertRuleRequest, error) {
+	var req AlertRuleRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return req, badRequest("Invalid JSON body")
+	}
+
+	if !slices.Contains(AlertKinds, req.Kind) {
+		return req, badRequest("kind must be one of: " + strings.Join(AlertKinds, ", "))
+	}
+	if req.Threshold <= 0 {
+		return req, badRequest("threshold must be greater than 0")
+	}
+	if req.Kind == AlertDrop && req.Threshold >= 100 {
+		return req, badRequest("threshold of a drop alert is a percentage below 100")
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	req.WebhookURL = strings.TrimSpace(req.WebhookURL)
+	if req.Email == "" && req.WebhookURL == "" {
+		return req, badRequest("an email or webhook_url is required")
+	}
+	if req.Email != "" {
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			return req, badRequest("Invalid email address")
+		}
+	}
+	if req.WebhookURL != "" {
+		if err := validateOutboundURL(e.Request.Context(), req.WebhookURL); err != nil {
+			return req, badRequest("webhook_url " + err.Error())
+		}
+	}
+
+	return req, nil
+}
+
+// HandleListAlertRules lists a site's alert rules. Editors and owners may manage them.
+func (h *Handlers) HandleListAlertRules(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage alerts"})
+	}
+
+	rules, err := h.app.FindRecordsByFilter("alert_rules", "site = {:site}", "created", 0, 0, dbx.Params{"site": siteId})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]AlertRule, len(rules))
+	for i, rule := range rules {
+		result[i] = toAlertRule(rule)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleCreateAlertRule adds an alert rule to a site
+func (h *Handlers) HandleCreateAlertRule(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage alerts"})
+	}
+
+	req, err := parseAlertRuleRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	collection, err := h.app.FindCollectionByNameOrId("alert_rules")
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	rule := core.NewRecord(collection)
+	rule.Set("site", siteId)
+	setAlertRule(rule, req)
+
+	if err := h.app.Save(rule); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, toAlertRule(rule))
+}
+
+// HandleUpdateAlertRule replaces an alert rule's settings. Changing a rule
+// clears its firing state, so it's evaluated afresh.
+func (h *Handlers) HandleUpdateAlertRule(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage alerts"})
+	}
+
+	rule, err := h.findAlertRule(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	req, err := parseAlertRuleRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	setAlertRule(rule, req)
+	rule.Set("firing", false)
+
+	if err := h.app.Save(rule); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, toAlertRule(rule))
+}
+
+// HandleDeleteAlertRule deletes an alert rule and its history
+func (h *Handlers) HandleDeleteAlertRule(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage alerts"})
+	}
+
+	rule, err := h.findAlertRule(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	if err := h.app.Delete(rule); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// HandleAlertHistory lists a site's most recent alert events
+func (h *Handlers) HandleAlertHistory(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage alerts"})
+	}
+
+	events, err := h.app.FindRecordsByFilter("alert_events", "site = {:site}", "-created", alertHistoryLimit, 0, dbx.Params{"site": siteId})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]AlertEvent, len(events))
+	for i, event := range events {
+		result[i] = AlertEvent{
+			ID:      event.Id,
+			RuleID:  event.GetString("rule"),
+			Status:  event.GetString("status"),
+			Message: event.GetString("message"),
+			Value:   event.GetFloat("value"),
+			Error:   event.GetString("error"),
+			Created: event.GetDateTime("created").Time().Format(time.RFC3339),
+		}
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// findAlertRule loads the {ruleId} alert rule of a site
+func (h *Handlers) findAlertRule(e *core.RequestEvent, siteId string) (*core.Record, error) {
+	rule, err := h.app.FindFirstRecordByFilter("alert_rules", "id = {:id} && site = {:site}", dbx.Params{
+		"id":   e.Request.PathValue("ruleId"),
+		"site": siteId,
+	})
+	if err != nil {
+		return nil, &apiError{status: http.StatusNotFound, message: "Alert rule not found"}
+	}
+	return rule, nil
+}
+
+// setAlertRule copies a validated request onto an alert_rules record
+func setAlertRule(rule *core.Record, req AlertRuleRequest) {
+	rule.Set("kind", req.Kind)
+	rule.Set("threshold", req.Threshold)
+	rule.Set("email", req.Email)
+	rule.Set("webhook_url", req.WebhookURL)
+	rule.Set("active", req.Active == nil || *req.Active)
+}
+
+// toAlertRule converts an alert_rules record for the alert endpoints
+func toAlertRule(rule *core.Record) AlertRule {
+	result := AlertRule{
+		ID:         rule.Id,
+		Kind:       rule.GetString("kind"),
+		Threshold:  rule.GetFloat("threshold"),
+		Email:      rule.GetString("email"),
+		WebhookURL: rule.GetString("webhook_url"),
+		Active:     rule.GetBool("active"),
+		Firing:     rule.GetBool("firing"),
+	}
+	if last := rule.GetDateTime("last_triggered"); !last.IsZero() {
+		result.LastTriggered = last.Time().Format(time.RFC3339)
+	}
+	return result
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var apiLog = logging.Component("api")
+
+const (
+	apiDateLayout        = "2006-01-02"
+	apiDefaultRangeDays  = 30
+	apiDefaultLimit      = 10
+	apiMaxLimit          = 1000
+	apiMaxTimeseriesDays = 366
+)
+
+// apiRange is the inclusive date range echoed back in API responses
+type apiRange struct {
+	SiteID string `json:"site_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// HandleAPIStats returns aggregate pageviews and visitors for a date range
+func (h *Handlers) HandleAPIStats(e *core.RequestEvent) error {
+	q, r, err := h.parseStatsQuery(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result, err := QueryAggregate(h.app, q)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": r.SiteID,
+		"from":    r.From,
+		"to":      r.To,
+		"results": result,
+	})
+}
+
+// HandleAPITimeseries returns pageviews per day (or hour with interval=hour)
+func (h *Handlers) HandleAPITimeseries(e *core.RequestEvent) error {
+	q, r, err := h.parseStatsQuery(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	interval := e.Request.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "day" && interval != "hour" {
+		return writeAPIError(e, badRequest("interval must be day or hour"))
+	}
+	if q.To.Sub(q.From) > apiMaxTimeseriesDays*24*time.Hour {
+		return writeAPIError(e, badRequest("date range too large for a timeseries"))
+	}
+
+	points, err := QueryTimeseries(h.app, q, interval)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id":  r.SiteID,
+		"from":     r.From,
+		"to":       r.To,
+		"interval": interval,
+		"results":  points,
+	})
+}
+
+// HandleAPIBreakdown returns pageviews grouped by a property with pagination
+func (h *Handlers) HandleAPIBreakdown(e *core.RequestEvent) error {
+	q, r, err := h.parseStatsQuery(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	params := e.Request.URL.Query()
+
+	property := params.Get("property")
+	if _, ok := breakdownColumns[property]; !ok && !slices.Contains(importedOnlyProperties, property) {
+		return writeAPIError(e, badRequest("property must be one of: "+strings.Join(append(BreakdownProperties(), importedOnlyProperties...), ", ")))
+	}
+
+	limit, err := parsePositiveInt(params.Get("limit"), apiDefaultLimit)
+	if err != nil || limit > apiMaxLimit {
+		return writeAPIError(e, badRequest("limit must be between 1 and 1000"))
+	}
+
+	page, err := parsePositiveInt(params.Get("page"), 1)
+	if err != nil {
+		return writeAPIError(e, badRequest("page must be a positive integer"))
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	items, err := QueryBreakdown(h.app, q, property, limit+1, (page-1)*limit)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id":  r.SiteID,
+		"from":     r.From,
+		"to":       r.To,
+		"property": property,
+		"page":     page,
+		"limit":    limit,
+		"has_more": hasMore,
+		"results":  items,
+	})
+}
+
+// parseStatsQuery builds a StatsQuery from the site path param and the
+// from/to (YYYY-MM-DD, inclusive) and filter query params
+func (h *Handlers) parseStatsQuery(e *core.RequestEvent) (StatsQuery, apiRange, error) {
+	siteId := e.Request.PathValue("siteId")
+	if _, err := h.app.FindRecordById("sites", siteId); err != nil {
+		return StatsQuery{}, apiRange{}, &apiError{status: http.StatusNotFound, message: "Site not found"}
+	}
+
+	params := e.Request.URL.Query()
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := params.Get("to"); v != "" {
+		parsed, err := time.Parse(apiDateLayout, v)
+		if err != nil {
+			return StatsQuery{}, apiRange{}, badRequest("to must be a YYYY-MM-DD date")
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -(apiDefaultRangeDays - 1))
+	if v := params.Get("from"); v != "" {
+		parsed, err := time.Parse(apiDateLayout, v)
+		if err != nil {
+			return StatsQuery{}, apiRange{}, badRequest("from must be a YYYY-MM-DD date")
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return StatsQuery{}, apiRange{}, badRequest("from must not be after to")
+	}
+
+	filters, err := ParseFilters(params)
+	if err != nil {
+		return StatsQuery{}, apiRange{}, badRequest(err.Error())
+	}
+
+	q := StatsQuery{
+		SiteID:  siteId,
+		From:    from,
+		To:      to.AddDate(0, 0, 1),
+		Filters: filters,
+	}
+
+	return q, apiRange{SiteID: siteId, From: from.Format(apiDateLayout), To: to.Format(apiDateLayout)}, nil
+}
+
+// parsePositiveInt parses an optional positive integer query param
+func parsePositiveInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
+
+// apiError is an API failure with the HTTP status to respond with
+type apiError struct {
+	status  int
+	message string
+}
+
+func (err *apiError) Error() string {
+	return err.message
+}
+
+// badRequest creates a 400 apiError
+func badRequest(message string) error {
+	return &apiError{status: http.StatusBadRequest, message: message}
+}
+
+// writeAPIError writes err as a JSON error response. Errors other than
+// apiError are logged and reported as a generic 500.
+func writeAPIError(e *core.RequestEvent, err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return e.JSON(apiErr.status, map[string]string{
+			"error": apiErr.message,
+		})
+	}
+
+	apiLog.ErrorContext(e.Request.Context(), "Query failed", "path", e.Request.URL.Path, "error", err)
+	return e.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Internal error",
+	})
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+	"github.com/abigpotostew/dingdong/internal/metrics"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var cacheLog = logging.Component("cache")
+
+// DefaultStatsCacheTTL is the default STATS_CACHE_TTL
+const DefaultStatsCacheTTL = 30 * time.Second
+
+// statsCacheClosedTTL is how long results of ranges that ended are cached.
+// Their pageviews only change when they're pruned, purged or imported, which
+// invalidates them: right away when the server does it, and within
+// statsCacheWatchInterval when a CLI command does.
+const statsCacheClosedTTL = time.Hour
+
+// statsCacheWatchInterval is how often the server checks whether another
+// process invalidated the stats cache
+const statsCacheWatchInterval = 5 * time.Second
+
+// statsCacheMaxEntries bounds the cache's memory use
+const statsCacheMaxEntries = 10000
+
+// statsCache holds recent stats query results, so a site page opened by
+// several people, and its JSON API, share one set of queries
+var statsCache = &queryCache{ttl: DefaultStatsCacheTTL, entries: map[string]cacheEntry{}}
+
+type cacheEntry struct {
+	site    string // "" for results over all sites
+	value   any
+	expires time.Time
+}
+
+type queryCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration // for ranges that include now; 0 disables the cache
+	entries    map[string]cacheEntry
+	generation int // the stats counter in cache_generations the entries are current with
+}
+
+// ConfigureStatsCache reads STATS_CACHE_TTL, how long results of ranges that
+// include the current time are cached. "0" turns the cache off.
+func ConfigureStatsCache() error {
+	ttl := DefaultStatsCacheTTL
+	if value := os.Getenv("STATS_CACHE_TTL"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			return fmt.Errorf("invalid STATS_CACHE_TTL %q: use a duration such as 30s, or 0 to disable", value)
+		}
+	}
+
+	statsCache.mu.Lock()
+	defer statsCache.mu.Unlock()
+	statsCache.ttl = ttl
+	statsCache.entries = map[string]cacheEntry{}
+	return nil
+}
+
+// StatsCacheSize returns the number of cached stats query results
+func StatsCacheSize() int {
+	statsCache.mu.Lock()
+	defer statsCache.mu.Unlock()
+	return len(statsCache.entries)
+}
+
+// InvalidateStatsCache drops the cached results of a site, or of every site
+// if siteId is empty, after its pageviews changed. It also bumps the stats
+// generation in the database, so a server running in another process, e.g.
+// while a CLI command prunes or imports, drops its cache too.
+func InvalidateStatsCache(app core.App, siteId string) {
+	var generation int
+	err := app.DB().
+		NewQuery("UPDATE cache_generations SET generation = generation + 1 WHERE name = 'stats' RETURNING generation").
+		Row(&generation)
+	if err != nil {
+		cacheLog.Warn("Failed to bump the stats cache generation", "error", err)
+	}
+
+	statsCache.mu.Lock()
+	defer statsCache.mu.Unlock()
+
+	for key, entry := range statsCache.entries {
+		if siteId == "" || entry.site == "" || entry.site == siteId {
+			delete(statsCache.entries, key)
+		}
+	}
+	// Another process's bump in between still has to drop everything
+	if err == nil && generation == statsCache.generation+1 {
+		statsCache.generation = generation
+	}
+}
+
+// WatchStatsCache drops every cached result when another process bumped the
+// stats generation, until ctx is done
+func WatchStatsCache(ctx context.Context, app core.App) {
+	ticker := time.NewTicker(statsCacheWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var generation int
+		err := app.DB().NewQuery("SELECT generation FROM cache_generations WHERE name = 'stats'").Row(&generation)
+		if err != nil {
+			cacheLog.Warn("Failed to read the stats cache generation", "error", err)
+			continue
+		}
+
+		statsCache.mu.Lock()
+		if generation != statsCache.generation {
+			statsCache.entries = map[string]cacheEntry{}
+			statsCache.generation = generation
+		}
+		statsCache.mu.Unlock()
+	}
+}
+
+// cachedQuery returns the cached result of query, or runs it and caches the
+// result. Results of ranges ending before now are kept longer. Callers must
+// not modify what they get back, as it's shared.
+func cachedQuery[T any](query, site string, to time.Time, key string, run func() (T, error)) (T, error) {
+	c := statsCache
+	key = query + "|" + site + "|" + key
+
+	now := time.Now()
+	c.mu.Lock()
+	ttl := c.ttl
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ttl == 0 {
+		return run()
+	}
+	if ok && now.Before(entry.expires) {
+		metrics.StatsCache.Inc(query, metrics.CacheHit)
+		return entry.value.(T), nil
+	}
+	metrics.StatsCache.Inc(query, metrics.CacheMiss)
+
+	value, err := run()
+	if err != nil {
+		return value, err
+	}
+
+	if !to.IsZero() && !to.After(now) {
+		ttl = statsCacheClosedTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= statsCacheMaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry{site: site, value: value, expires: now.Add(ttl)}
+	return value, nil
+}
+
+// evict drops expired entries, and some unexpired ones if that isn't enough
+// to make room. c.mu must be held.
+func (c *queryCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < statsCacheMaxEntries*9/10 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// cacheKey identifies the range and filters of the query
+func (q StatsQuery) cacheKey() string {
+	var b strings.Builder
+	b.WriteString(formatCacheTime(q.From))
+	b.WriteString("|")
+	b.WriteString(formatCacheTime(q.To))
+
+	// The same filters in another order select the same pageviews
+	filters := make([]string, len(q.Filters))
+	for i, f := range q.Filters {
+		filters[i] = strconv.Quote(f.String())
+	}
+	sort.Strings(filters)
+	for _, f := range filters {
+		b.WriteString("|")
+		b.WriteString(f)
+	}
+	return b.String()
+}
+
+func formatCacheTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(dbTimeLayout)
+}
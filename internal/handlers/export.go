@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var exportLog = logging.Component("export")
+
+// exportFlushEvery is how many rows are written between flushes while streaming
+const exportFlushEvery = 500
+
+// PageviewExport is a single exported pageview. The field order is the
+// column order of every raw export format and must stay stable.
+type PageviewExport struct {
+	ID           string `db:"id" json:"id"`
+	Site         string `db:"site" json:"site"`
+	Created      string `db:"created" json:"created"`
+	Path         string `db:"path" json:"path"`
+	Referrer     string `db:"referrer" json:"referrer"`
+	Country      string `db:"country" json:"country"`
+	Browser      string `db:"browser" json:"browser"`
+	OS           string `db:"os" json:"os"`
+	Device       string `db:"device" json:"device"`
+	ScreenWidth  int    `db:"screen_width" json:"screen_width"`
+	ScreenHeight int    `db:"screen_height" json:"screen_height"`
+	VisitorHash  string `db:"ip_hash" json:"visitor_hash"`
+	UserAgent    string `db:"user_agent" json:"user_agent"`
+}
+
+// PageviewExportColumns are the raw export column names, in PageviewExport field order
+var PageviewExportColumns = []string{
+	"id", "site", "created", "path", "referrer", "country", "browser", "os",
+	"device", "screen_width", "screen_height", "visitor_hash", "user_agent",
+}
+
+// Values returns the pageview as strings in PageviewExportColumns order
+func (p PageviewExport) Values() []string {
+	return []string{
+		p.ID, p.Site, p.Created, p.Path, p.Referrer, p.Country, p.Browser, p.OS,
+		p.Device, strconv.Itoa(p.ScreenWidth), strconv.Itoa(p.ScreenHeight), p.VisitorHash, p.UserAgent,
+	}
+}
+
+// StreamPageviews calls fn for every pageview matching the query, oldest
+// first, reading rows one at a time instead of loading them all into memory
+func StreamPageviews(app *pocketbase.PocketBase, q StatsQuery, fn func(PageviewExport) error) error {
+	where, params := q.where()
+
+	rows, err := app.DB().
+		NewQuery("SELECT id, site, created, path, referrer, country, browser, os, device, screen_width, screen_height, ip_hash, user_agent FROM pageviews WHERE " + where + " ORDER BY created ASC, id ASC").
+		Bind(params).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pv PageviewExport
+		if err := rows.ScanStruct(&pv); err != nil {
+			return err
+		}
+
+		// Normalize the stored datetime to RFC 3339
+		if created, err := time.Parse(dbTimeLayout, pv.Created); err == nil {
+			pv.Created = created.Format(time.RFC3339Nano)
+		}
+
+		if err := fn(pv); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// exportReports maps the report names accepted by HandleExportReport to breakdown properties
+var exportReports = map[string]string{
+	"pages":     "path",
+	"referrers": "referrer",
+	"browsers":  "browser",
+	"os":        "os",
+	"devices":   "device",
+	"countries": "country",
+	"sources":   "source",
+}
+
+// HandleExportReport exports a stats report (pages, referrers, daily, ...) as CSV or JSON
+func (h *Handlers) HandleExportReport(e *core.RequestEvent) error {
+	q, r, err := h.parseStatsQuery(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+	if err := h.checkExportAccess(e, q.SiteID); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	format := e.Request.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return writeAPIError(e, badRequest("format must be csv or json"))
+	}
+
+	report := e.Request.PathValue("report")
+
+	var header []string
+	var rows [][]string
+	var results any
+
+	if report == "daily" {
+		if q.To.Sub(q.From) > apiMaxTimeseriesDays*24*time.Hour {
+			return writeAPIError(e, badRequest("date range too large for a timeseries"))
+		}
+		points, err := QueryTimeseries(h.app, q, "day")
+		if err != nil {
+			return writeAPIError(e, err)
+		}
+		header = []string{"date", "pageviews", "visitors"}
+		for _, p := range points {
+			rows = append(rows, []string{p.Date, strconv.Itoa(p.Pageviews), strconv.Itoa(p.Visitors)})
+		}
+		results = points
+	} else {
+		property, ok := exportReports[report]
+		if !ok {
+			return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Unknown report: " + report})
+		}
+		// A negative LIMIT means no limit in SQLite
+		items, err := QueryBreakdown(h.app, q, property, -1, 0)
+		if err != nil {
+			return writeAPIError(e, err)
+		}
+		header = []string{property, "pageviews", "visitors"}
+		for _, item := range items {
+			rows = append(rows, []string{item.Value, strconv.Itoa(item.Pageviews), strconv.Itoa(item.Visitors)})
+		}
+		results = items
+	}
+
+	setExportHeaders(e, fmt.Sprintf("%s-%s-%s-%s", r.SiteID, report, r.From, r.To), format)
+
+	if format == "json" {
+		return json.NewEncoder(e.Response).Encode(map[string]any{
+			"site_id": r.SiteID,
+			"from":    r.From,
+			"to":      r.To,
+			"report":  report,
+			"results": results,
+		})
+	}
+
+	w := csv.NewWriter(e.Response)
+	w.Write(header)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// HandleExportPageviews streams the raw pageviews of a date range as CSV, NDJSON
+// or a zip of partitioned Parquet files
+func (h *Handlers) HandleExportPageviews(e *core.RequestEvent) error {
+	q, r, err := h.parseStatsQuery(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+	if err := h.checkExportAccess(e, q.SiteID); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	format := e.Request.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	// Large exports can outlive the server's default write timeout
+	rc := http.NewResponseController(e.Response)
+	rc.SetWriteDeadline(time.Time{})
+
+	if format == "parquet" {
+		return h.exportParquet(e, q, r)
+	}
+
+	var write func(PageviewExport) error
+	var flush func() error
+
+	switch format {
+	case "csv":
+		w := csv.NewWriter(e.Response)
+		write = func(pv PageviewExport) error { return w.Write(pv.Values()) }
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+		setExportHeaders(e, fmt.Sprintf("%s-pageviews-%s-%s", r.SiteID, r.From, r.To), format)
+		if err := w.Write(PageviewExportColumns); err != nil {
+			return err
+		}
+	case "ndjson":
+		enc := json.NewEncoder(e.Response)
+		write = func(pv PageviewExport) error { return enc.Encode(pv) }
+		flush = func() error { return nil }
+		setExportHeaders(e, fmt.Sprintf("%s-pageviews-%s-%s", r.SiteID, r.From, r.To), format)
+	default:
+		return writeAPIError(e, badRequest("format must be csv, ndjson or parquet"))
+	}
+
+	count := 0
+	err = StreamPageviews(h.app, q, func(pv PageviewExport) error {
+		if err := write(pv); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			return e.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, so the best we can do is stop the stream
+		exportLog.WarnContext(e.Request.Context(), "Pageview export aborted", "site", q.SiteID, "rows", count, "error", err)
+		return nil
+	}
+
+	return flush()
+}
+
+// exportParquet streams the pageviews as a zip of the same partitioned Parquet
+// files the export command writes
+func (h *Handlers) exportParquet(e *core.RequestEvent, q StatsQuery, r apiRange) error {
+	setExportHeaders(e, fmt.Sprintf("%s-pageviews-%s-%s", r.SiteID, r.From, r.To), "zip")
+
+	archive := zip.NewWriter(e.Response)
+	files, rows, err := WriteParquetPartitions(h.app, q, func(name string) (io.WriteCloser, error) {
+		// Parquet is already compressed, so partitions are stored as is
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		return nopCloser{w}, e.Flush()
+	})
+	if err != nil {
+		exportLog.WarnContext(e.Request.Context(), "Parquet export aborted", "site", q.SiteID, "files", files, "rows", rows, "error", err)
+		return nil
+	}
+
+	return archive.Close()
+}
+
+// nopCloser adds a no-op Close to a zip entry writer
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// checkExportAccess makes sure a signed-in user can view the site. Requests
+// authorized by an API token were already checked by the API middleware.
+func (h *Handlers) checkExportAccess(e *core.RequestEvent, siteId string) error {
+	if e.Auth != nil && !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return &apiError{status: http.StatusNotFound, message: "Site not found"}
+	}
+	return nil
+}
+
+// setExportHeaders sets the content type and download filename of an export
+func setExportHeaders(e *core.RequestEvent, name, format string) {
+	contentTypes := map[string]string{
+		"csv":    "text/csv; charset=utf-8",
+		"json":   "application/json; charset=utf-8",
+		"ndjson": "application/x-ndjson; charset=utf-8",
+		"zip":    "application/zip",
+	}
+
+	e.Response.Header().Set("Content-Type", contentTypes[format])
+	e.Response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	e.Response.Header().Set("Cache-Control", "no-store")
+}
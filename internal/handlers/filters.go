@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/dbx"
+	"modernc.org/sqlite"
+)
+
+// Filter operators
+const (
+	FilterIs       = "is"
+	FilterIsNot    = "is_not"
+	FilterContains = "contains" // case-insensitive substring
+	FilterMatches  = "matches"  // RE2 regular expression
+)
+
+var filterOps = []string{FilterIs, FilterIsNot, FilterContains, FilterMatches}
+
+const (
+	// maxFilters bounds the conditions a single query can carry
+	maxFilters = 10
+
+	// maxFilterPattern bounds the length of a regular expression filter
+	maxFilterPattern = 256
+)
+
+// Filter narrows a stats query to the pageviews whose property matches a value
+type Filter struct {
+	Property string `json:"property"`
+	Op       string `json:"op"`
+	Value    string `json:"value"`
+}
+
+// String formats the filter as in the filter query param: property:op:value
+func (f Filter) String() string {
+	return f.Property + ":" + f.Op + ":" + f.Value
+}
+
+// ParseFilter parses a property:op:value filter. The value may contain colons.
+func ParseFilter(s string) (Filter, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return Filter{}, fmt.Errorf("filter %q must be property:op:value", s)
+	}
+
+	f := Filter{Property: parts[0], Op: parts[1], Value: parts[2]}
+	return f, f.validate()
+}
+
+// ParseFilters reads the repeatable filter param (property:op:value) and, as
+// a shorthand for "is", any breakdown property given as its own param, e.g.
+// ?path=/pricing
+func ParseFilters(params url.Values) ([]Filter, error) {
+	var filters []Filter
+	for _, s := range params["filter"] {
+		f, err := ParseFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	for _, property := range BreakdownProperties() {
+		if v := params.Get(property); v != "" {
+			filters = append(filters, Filter{Property: property, Op: FilterIs, Value: v})
+		}
+	}
+
+	if len(filters) > maxFilters {
+		return nil, fmt.Errorf("at most %d filters are allowed", maxFilters)
+	}
+	return filters, nil
+}
+
+func (f Filter) validate() error {
+	if _, ok := breakdownColumns[f.Property]; !ok {
+		return fmt.Errorf("unsupported filter property %q", f.Property)
+	}
+
+	switch f.Op {
+	case FilterIs, FilterIsNot:
+		// An empty value is meaningful, e.g. referrer:is: for direct traffic
+	case FilterContains:
+		if f.Value == "" {
+			return fmt.Errorf("filter %s needs a value", f)
+		}
+	case FilterMatches:
+		if len(f.Value) > maxFilterPattern {
+			return fmt.Errorf("filter pattern is longer than %d characters", maxFilterPattern)
+		}
+		if _, err := compileFilterPattern(f.Value); err != nil {
+			return fmt.Errorf("invalid filter pattern %q", f.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported filter operator %q: use %s", f.Op, strings.Join(filterOps, ", "))
+	}
+	return nil
+}
+
+// condition returns the SQL condition of the filter, binding its value to
+// params under name. Filters must be valid.
+func (f Filter) condition(name string, params dbx.Params) string {
+	column := breakdownColumns[f.Property]
+
+	switch f.Op {
+	case FilterIsNot:
+		params[name] = f.Value
+		return fmt.Sprintf("%s != {:%s}", column, name)
+	case FilterContains:
+		params[name] = "%" + likeEscaper.Replace(f.Value) + "%"
+		return fmt.Sprintf(`%s LIKE {:%s} ESCAPE '\'`, column, name)
+	case FilterMatches:
+		params[name] = f.Value
+		return fmt.Sprintf("%s REGEXP {:%s}", column, name)
+	default:
+		params[name] = f.Value
+		return fmt.Sprintf("%s = {:%s}", column, name)
+	}
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// WithFilter returns filters plus f, replacing an existing filter of the same
+// property and operator
+func WithFilter(filters []Filter, f Filter) []Filter {
+	result := slices.DeleteFunc(slices.Clone(filters), func(existing Filter) bool {
+		return existing.Property == f.Property && existing.Op == f.Op
+	})
+	return append(result, f)
+}
+
+// FilterQuery encodes filters as a query string, starting with "?" unless
+// there are none
+func FilterQuery(filters []Filter) string {
+	if len(filters) == 0 {
+		return "?"
+	}
+	params := url.Values{}
+	for _, f := range filters {
+		params.Add("filter", f.String())
+	}
+	return "?" + params.Encode()
+}
+
+var (
+	filterPatternsMu sync.Mutex
+	filterPatterns   = map[string]*regexp.Regexp{}
+)
+
+// compileFilterPattern compiles a regular expression filter, reusing the
+// patterns of recent queries as SQLite calls REGEXP once per row
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	filterPatternsMu.Lock()
+	defer filterPatternsMu.Unlock()
+
+	if re, ok := filterPatterns[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(filterPatterns) >= 100 {
+		clear(filterPatterns)
+	}
+	filterPatterns[pattern] = re
+	return re, nil
+}
+
+// SQLite has a REGEXP operator but no implementation of it; X REGEXP Y
+// calls regexp(Y, X)
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, _ := args[0].(string)
+		var value string
+		switch v := args[1].(type) {
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		}
+
+		re, err := compileFilterPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(value), nil
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"html/template"
 
 	"github.com/pocketbase/pocketbase"
@@ -8,14 +9,28 @@ import (
 
 // Handlers contains all HTTP handlers for the application
 type Handlers struct {
-	app  *pocketbase.PocketBase
-	tmpl *template.Template
+	app   *pocketbase.PocketBase
+	tmpl  *template.Template
+	live  *LiveHub
+	hooks *WebhookWorker
 }
 
 // New creates a new Handlers instance
 func New(app *pocketbase.PocketBase, tmpl *template.Template) *Handlers {
 	return &Handlers{
-		app:  app,
-		tmpl: tmpl,
+		app:   app,
+		tmpl:  tmpl,
+		live:  NewLiveHub(),
+		hooks: NewWebhookWorker(app),
 	}
 }
+
+// RunWebhooks delivers outgoing webhooks until ctx is done
+func (h *Handlers) RunWebhooks(ctx context.Context) {
+	h.hooks.Run(ctx)
+}
+
+// WebhookStatus reports on the webhook worker and its queue
+func (h *Handlers) WebhookStatus() WebhookWorkerStatus {
+	return h.hooks.Status()
+}
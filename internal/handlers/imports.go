@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ImportDayLayout is the format of imported_stats days
+const ImportDayLayout = "2006-01-02"
+
+// Import sources, as stored in imported_stats.source
+const (
+	ImportSourcePlausible = "plausible"
+	ImportSourceGA4       = "ga4"
+)
+
+// importMaxValueLength matches the imported_stats value field
+const importMaxValueLength = 2048
+
+// ImportedStat is one day of imported counts, either the daily totals
+// (empty Dimension) or a single breakdown value such as a page path
+type ImportedStat struct {
+	Day       string
+	Dimension string
+	Value     string
+	Pageviews int
+	Visitors  int
+}
+
+// ImportResult summarizes a SaveImportedStats call
+type ImportResult struct {
+	Rows        int
+	From        string
+	To          string
+	SkippedDays int // days on or after the first tracked pageview
+}
+
+// ImportSummary describes the imported data of a site for the dashboard
+type ImportSummary struct {
+	Source string `db:"source"`
+	From   string `db:"from_day"`
+	To     string `db:"to_day"`
+}
+
+// plausibleFiles maps the tables of a Plausible CSV export to the breakdown
+// property they hold and the CSV columns to read its values from, in order of
+// preference. The visitors table holds the daily totals. Sources are names
+// like "Google" rather than referrer URLs, so they're kept apart from
+// referrers.
+var plausibleFiles = map[string]struct {
+	dimension string
+	columns   []string
+}{
+	"visitors":          {"", nil},
+	"pages":             {"path", []string{"page"}},
+	"sources":           {"source", []string{"source"}},
+	"browsers":          {"browser", []string{"browser"}},
+	"operating_systems": {"os", []string{"operating_system"}},
+	"devices":           {"device", []string{"device"}},
+	"locations":         {"country", []string{"country"}},
+}
+
+// ParsePlausibleExport reads the daily tables of a Plausible CSV export zip
+// (imported_visitors_*.csv, imported_pages_*.csv, ...). Tables that don't
+// map to a DingDong breakdown, like entry pages or custom events, are ignored.
+func ParsePlausibleExport(r io.ReaderAt, size int64) ([]ImportedStat, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("not a zip file: %w", err)
+	}
+
+	var stats []ImportedStat
+	tables := 0
+	for _, file := range archive.File {
+		table, ok := plausibleTable(file.Name)
+		if !ok {
+			continue
+		}
+		spec := plausibleFiles[table]
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		columns := csvColumns(rows[0])
+		dateCol := csvColumn(columns, "date")
+		if dateCol < 0 {
+			return nil, fmt.Errorf("%s: missing date column", file.Name)
+		}
+		// Only some tables count pageviews; visits are the closest substitute
+		pageviewsCol := csvColumn(columns, "pageviews", "visits")
+		visitorsCol := csvColumn(columns, "visitors")
+
+		for _, row := range rows[1:] {
+			day, err := parseImportDay(row[dateCol])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+
+			stat := ImportedStat{
+				Day:       day,
+				Dimension: spec.dimension,
+				Pageviews: csvInt(row, pageviewsCol),
+				Visitors:  csvInt(row, visitorsCol),
+			}
+			for _, name := range spec.columns {
+				if i := csvColumn(columns, name); i >= 0 && row[i] != "" {
+					stat.Value = row[i]
+					break
+				}
+			}
+			if spec.dimension == "device" {
+				stat.Value = strings.ToLower(stat.Value)
+			}
+			stats = append(stats, stat)
+		}
+		tables++
+	}
+
+	if tables == 0 {
+		return nil, errors.New("no Plausible tables found in the export")
+	}
+
+	return stats, nil
+}
+
+// plausibleTable returns the table name of a Plausible export file, e.g.
+// "pages" for imported_pages_20230101_20231231.csv
+func plausibleTable(name string) (string, bool) {
+	name, ok := strings.CutSuffix(path.Base(name), ".csv")
+	if !ok {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, "imported_")
+
+	for table := range plausibleFiles {
+		if name == table || strings.HasPrefix(name, table+"_") {
+			return table, true
+		}
+	}
+	return "", false
+}
+
+// ga4Columns maps GA4 report dimension names to breakdown properties
+var ga4Columns = map[string]string{
+	"page path and screen class":                "path",
+	"page path":                                 "path",
+	"page path + query string":                  "path",
+	"page path + query string and screen class": "path",
+	"page referrer":                             "referrer",
+	"session source":                            "source",
+	"browser":                                   "browser",
+	"operating system":                          "os",
+	"device category":                           "device",
+	"country id":                                "country",
+}
+
+// ParseGA4CSV reads a CSV downloaded from a GA4 report or exploration that
+// has a Date dimension, an optional second dimension (page path, browser,
+// ...) and the Views and/or Users metrics
+func ParseGA4CSV(r io.Reader) ([]ImportedStat, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// GA4 puts a "#" comment block before the table and may append more
+	// tables after a blank line; only the first table is read
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			if len(lines) > 0 {
+				break
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no table found in the CSV")
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	dateCol, pageviewsCol, visitorsCol, valueCol := -1, -1, -1, -1
+	dimension := ""
+	for i, name := range rows[0] {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "date":
+			dateCol = i
+		case "views", "screen page views", "screenpage views":
+			pageviewsCol = i
+		case "total users", "users", "active users":
+			visitorsCol = i
+		default:
+			if property, ok := ga4Columns[name]; ok {
+				if valueCol >= 0 {
+					return nil, errors.New("only one dimension besides Date is supported")
+				}
+				valueCol, dimension = i, property
+			}
+		}
+	}
+	if dateCol < 0 {
+		return nil, errors.New("missing Date column")
+	}
+	if pageviewsCol < 0 && visitorsCol < 0 {
+		return nil, errors.New("missing Views or Users column")
+	}
+
+	var stats []ImportedStat
+	for _, row := range rows[1:] {
+		// Skip totals rows and anything else without a date
+		if len(row) != len(rows[0]) {
+			continue
+		}
+		day, err := parseImportDay(row[dateCol])
+		if err != nil {
+			continue
+		}
+
+		stat := ImportedStat{
+			Day:       day,
+			Dimension: dimension,
+			Pageviews: csvInt(row, pageviewsCol),
+			Visitors:  csvInt(row, visitorsCol),
+		}
+		if valueCol >= 0 {
+			stat.Value = row[valueCol]
+			// GA4's placeholders for missing values count as no value
+			if stat.Value == "(not set)" || stat.Value == "(direct)" {
+				stat.Value = ""
+			}
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+// SaveImportedStats stores imported stats for a site. Rows for the days and
+// properties in stats replace any earlier import from the same source, so
+// imports can be re-run. Days on or after the site's first tracked pageview
+// are skipped to avoid counting them twice.
+func SaveImportedStats(app *pocketbase.PocketBase, siteId, source string, stats []ImportedStat) (ImportResult, error) {
+	var result ImportResult
+
+	var first struct {
+		Created string `db:"created"`
+	}
+	err := app.DB().
+		NewQuery("SELECT COALESCE(MIN(created), '') as created FROM pageviews WHERE site = {:site} AND spam = FALSE").
+		Bind(dbx.Params{"site": siteId}).
+		One(&first)
+	if err != nil {
+		return result, err
+	}
+	firstTracked := ""
+	if len(first.Created) >= len(ImportDayLayout) {
+		firstTracked = first.Created[:len(ImportDayLayout)]
+	}
+
+	// Sum rows that collapse to the same value, e.g. browser versions or cities
+	type key struct{ day, dimension, value string }
+	merged := map[key]*ImportedStat{}
+	skipped := map[string]bool{}
+	dimensions := map[string]bool{}
+	for _, s := range stats {
+		if firstTracked != "" && s.Day >= firstTracked {
+			skipped[s.Day] = true
+			continue
+		}
+		if len(s.Value) > importMaxValueLength {
+			s.Value = s.Value[:importMaxValueLength]
+		}
+
+		k := key{s.Day, s.Dimension, s.Value}
+		if m, ok := merged[k]; ok {
+			m.Pageviews += s.Pageviews
+			m.Visitors += s.Visitors
+			continue
+		}
+		stat := s
+		merged[k] = &stat
+		dimensions[s.Dimension] = true
+
+		if result.From == "" || s.Day < result.From {
+			result.From = s.Day
+		}
+		if s.Day > result.To {
+			result.To = s.Day
+		}
+	}
+	result.SkippedDays = len(skipped)
+
+	if len(merged) == 0 {
+		return result, nil
+	}
+
+	collection, err := app.FindCollectionByNameOrId("imported_stats")
+	if err != nil {
+		return result, err
+	}
+
+	err = app.RunInTransaction(func(txApp core.App) error {
+		for dimension := range dimensions {
+			_, err := txApp.DB().
+				NewQuery("DELETE FROM imported_stats WHERE site = {:site} AND source = {:source} AND dimension = {:dimension} AND day >= {:from} AND day <= {:to}").
+				Bind(dbx.Params{"site": siteId, "source": source, "dimension": dimension, "from": result.From, "to": result.To}).
+				Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, s := range merged {
+			record := core.NewRecord(collection)
+			record.Set("site", siteId)
+			record.Set("source", source)
+			record.Set("day", s.Day)
+			record.Set("dimension", s.Dimension)
+			record.Set("value", s.Value)
+			record.Set("pageviews", s.Pageviews)
+			record.Set("visitors", s.Visitors)
+			if err := txApp.Save(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	InvalidateStatsCache(app, siteId)
+
+	result.Rows = len(merged)
+	return result, nil
+}
+
+// DeleteImportedStats removes a site's imported stats, optionally only those of one source
+func DeleteImportedStats(app *pocketbase.PocketBase, siteId, source string) (int64, error) {
+	query := "DELETE FROM imported_stats WHERE site = {:site}"
+	if source != "" {
+		query += " AND source = {:source}"
+	}
+
+	res, err := app.DB().NewQuery(query).Bind(dbx.Params{"site": siteId, "source": source}).Execute()
+	if err != nil {
+		return 0, err
+	}
+	InvalidateStatsCache(app, siteId)
+	return res.RowsAffected()
+}
+
+// ImportSummaries returns the sources and date ranges of a site's imported stats
+func ImportSummaries(app *pocketbase.PocketBase, siteId string) ([]ImportSummary, error) {
+	summaries := []ImportSummary{}
+	err := app.DB().
+		NewQuery("SELECT source, MIN(day) as from_day, MAX(day) as to_day FROM imported_stats WHERE site = {:site} GROUP BY source ORDER BY from_day").
+		Bind(dbx.Params{"site": siteId}).
+		All(&summaries)
+	return summaries, err
+}
+
+// ImportedPageviews returns the total pageviews imported for a site
+func ImportedPageviews(app *pocketbase.PocketBase, siteId string) (int, error) {
+	var imported struct {
+		Pageviews int `db:"pageviews"`
+	}
+	err := app.DB().
+		NewQuery("SELECT COALESCE(SUM(pageviews), 0) as pageviews FROM imported_stats WHERE site = {:site} AND dimension = ''").
+		Bind(dbx.Params{"site": siteId}).
+		One(&imported)
+	return imported.Pageviews, err
+}
+
+// parseImportDay accepts YYYY-MM-DD (Plausible) and YYYYMMDD (GA4) dates
+func parseImportDay(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{ImportDayLayout, "20060102"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(ImportDayLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q", value)
+}
+
+// csvColumns maps lower-cased CSV header names to their index
+func csvColumns(header []string) map[string]int {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return columns
+}
+
+// csvColumn returns the index of the first of names in columns, or -1
+func csvColumn(columns map[string]int, names ...string) int {
+	for _, name := range names {
+		if i, ok := columns[name]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// csvInt parses the integer in column i of row, treating missing or
+// malformed values (including GA4's "1,234" grouping) as 0
+func csvInt(row []string, i int) int {
+	if i < 0 || i >= len(row) {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.ReplaceAll(strings.TrimSpace(row[i]), ",", ""))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var liveLog = logging.Component("live")
+
+// liveWindow is how long a visitor counts as "current" after their last pageview
+const liveWindow = 5 * time.Minute
+
+// LivePageview is a pageview pushed to live dashboard subscribers
+type LivePageview struct {
+	Path      string    `json:"path"`
+	Referrer  string    `json:"referrer"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// LiveHub keeps in-memory per-site state for the live dashboard panel.
+// It's fed directly by HandlePing so the live view never polls the database.
+type LiveHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan LivePageview]struct{}
+	lastSeen    map[string]map[string]time.Time
+}
+
+// NewLiveHub creates an empty LiveHub
+func NewLiveHub() *LiveHub {
+	return &LiveHub{
+		subscribers: map[string]map[chan LivePageview]struct{}{},
+		lastSeen:    map[string]map[string]time.Time{},
+	}
+}
+
+// Publish records visitor activity and fans the pageview out to subscribers.
+// An empty visitorKey (e.g. anonymized pings) is still shown in the feed but
+// can't be counted as a distinct current visitor.
+func (l *LiveHub) Publish(siteId, visitorKey string, pv LivePageview) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Visitors are tracked whether or not anyone watches the live panel, so
+	// drop the ones that left here to keep the map from growing
+	l.pruneLocked(siteId)
+
+	if visitorKey != "" {
+		if l.lastSeen[siteId] == nil {
+			l.lastSeen[siteId] = map[string]time.Time{}
+		}
+		l.lastSeen[siteId][visitorKey] = pv.CreatedAt
+	}
+
+	for ch := range l.subscribers[siteId] {
+		select {
+		case ch <- pv:
+		default:
+			// Slow subscriber, drop the event rather than block ingestion
+		}
+	}
+}
+
+// ActiveVisitors returns the number of distinct visitors seen within liveWindow
+func (l *LiveHub) ActiveVisitors(siteId string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pruneLocked(siteId)
+	return len(l.lastSeen[siteId])
+}
+
+// pruneLocked forgets the site's visitors not seen within liveWindow.
+// l.mu must be held.
+func (l *LiveHub) pruneLocked(siteId string) {
+	cutoff := time.Now().Add(-liveWindow)
+	visitors := l.lastSeen[siteId]
+	for key, seen := range visitors {
+		if seen.Before(cutoff) {
+			delete(visitors, key)
+		}
+	}
+	if len(visitors) == 0 {
+		delete(l.lastSeen, siteId)
+	}
+}
+
+// Subscribe registers a channel that receives the site's live pageviews
+func (l *LiveHub) Subscribe(siteId string) chan LivePageview {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch := make(chan LivePageview, 16)
+	if l.subscribers[siteId] == nil {
+		l.subscribers[siteId] = map[chan LivePageview]struct{}{}
+	}
+	l.subscribers[siteId][ch] = struct{}{}
+
+	return ch
+}
+
+// Unsubscribe removes a channel previously returned by Subscribe
+func (l *LiveHub) Unsubscribe(siteId string, ch chan LivePageview) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.subscribers[siteId], ch)
+	if len(l.subscribers[siteId]) == 0 {
+		delete(l.subscribers, siteId)
+	}
+}
+
+// HandleLiveStream streams the current visitor count and incoming pageviews
+// for a site as Server-Sent Events
+func (h *Handlers) HandleLiveStream(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+
+	if _, err := h.app.FindRecordById("sites", siteId); err != nil || !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return e.JSON(http.StatusNotFound, map[string]string{
+			"error": "Site not found",
+		})
+	}
+
+	// Disable the global write deadline for the long-lived SSE connection
+	rc := http.NewResponseController(e.Response)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return e.InternalServerError("Failed to initialize SSE connection.", err)
+	}
+
+	e.Response.Header().Set("Content-Type", "text/event-stream")
+	e.Response.Header().Set("Cache-Control", "no-store")
+	e.Response.Header().Set("X-Accel-Buffering", "no")
+
+	ch := h.live.Subscribe(siteId)
+	defer h.live.Unsubscribe(siteId, ch)
+
+	if err := writeSSE(e, "visitors", h.live.ActiveVisitors(siteId)); err != nil {
+		return nil
+	}
+
+	// Periodically resend the count so visitors expire from the panel
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.Request.Context().Done():
+			return nil
+		case pv := <-ch:
+			if err := writeSSE(e, "pageview", pv); err != nil {
+				return nil
+			}
+			if err := writeSSE(e, "visitors", h.live.ActiveVisitors(siteId)); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if err := writeSSE(e, "visitors", h.live.ActiveVisitors(siteId)); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// writeSSE writes a single named Server-Sent Event with a JSON payload and flushes it
+func writeSSE(e *core.RequestEvent, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		liveLog.ErrorContext(e.Request.Context(), "Failed to encode event", "event", event, "error", err)
+		return err
+	}
+
+	if _, err := fmt.Fprintf(e.Response, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+
+	return e.Flush()
+}
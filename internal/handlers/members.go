@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var membersLog = logging.Component("members")
+
+// Site roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// SiteRoles lists every role a site member can have
+var SiteRoles = []string{RoleOwner, RoleEditor, RoleViewer}
+
+var roleRank = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// SiteRole returns auth's role on a site, or "" if it isn't a member.
+// Superusers are treated as owners of every site.
+func SiteRole(app core.App, auth *core.Record, siteId string) string {
+	if auth == nil {
+		return ""
+	}
+	if auth.IsSuperuser() {
+		return RoleOwner
+	}
+
+	member, err := app.FindFirstRecordByFilter("site_members", "site = {:site} && user = {:user}", dbx.Params{
+		"site": siteId,
+		"user": auth.Id,
+	})
+	if err != nil {
+		return ""
+	}
+
+	return member.GetString("role")
+}
+
+// HasSiteRole reports whether auth has at least role on the site
+func HasSiteRole(app core.App, auth *core.Record, siteId, role string) bool {
+	return roleRank[SiteRole(app, auth, siteId)] >= roleRank[role]
+}
+
+// VisibleSites returns the sites auth may view, newest first
+func VisibleSites(app core.App, auth *core.Record) ([]*core.Record, error) {
+	if auth == nil {
+		return []*core.Record{}, nil
+	}
+	if auth.IsSuperuser() {
+		return app.FindRecordsByFilter("sites", "1=1", "-created", 0, 0)
+	}
+
+	return app.FindRecordsByFilter(
+		"sites",
+		"@collection.site_members.site ?= id && @collection.site_members.user ?= {:user}",
+		"-created",
+		0,
+		0,
+		dbx.Params{"user": auth.Id},
+	)
+}
+
+// SiteMember is a site member as returned by the members endpoints
+type SiteMember struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+}
+
+// SiteMemberRequest is the body of the add/update member endpoint
+type SiteMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// HandleListSiteMembers lists a site's members. Only owners may see them.
+func (h *Handlers) HandleListSiteMembers(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleOwner) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site owners can manage members"})
+	}
+
+	members, err := h.app.FindRecordsByFilter("site_members", "site = {:site}", "created", 0, 0, dbx.Params{
+		"site": siteId,
+	})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	if errs := h.app.ExpandRecords(members, []string{"user"}, nil); len(errs) > 0 {
+		membersLog.ErrorContext(e.Request.Context(), "Failed to expand users", "site", siteId, "errors", errs)
+	}
+
+	result := make([]SiteMember, 0, len(members))
+	for _, m := range members {
+		member := SiteMember{UserID: m.GetString("user"), Role: m.GetString("role")}
+		if user := m.ExpandedOne("user"); user != nil {
+			member.Email = user.Email()
+			member.Name = user.GetString("name")
+		}
+		result = append(result, member)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleSetSiteMember adds a user (looked up by email) to a site, or changes
+// the role of an existing member. Only owners may do this.
+func (h *Handlers) HandleSetSiteMember(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleOwner) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site owners can manage members"})
+	}
+
+	var req SiteMemberRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return writeAPIError(e, badRequest("Invalid JSON body"))
+	}
+	if _, ok := roleRank[req.Role]; !ok {
+		return writeAPIError(e, badRequest("role must be one of: "+strings.Join(SiteRoles, ", ")))
+	}
+
+	user, err := h.app.FindAuthRecordByEmail("users", req.Email)
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "No user with that email"})
+	}
+
+	if req.Role != RoleOwner && h.isLastOwner(siteId, user.Id) {
+		return writeAPIError(e, badRequest("A site must keep at least one owner"))
+	}
+
+	if err := SetSiteMember(h.app, siteId, user.Id, req.Role); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, SiteMember{
+		UserID: user.Id,
+		Email:  user.Email(),
+		Name:   user.GetString("name"),
+		Role:   req.Role,
+	})
+}
+
+// HandleRemoveSiteMember removes a user from a site. Only owners may do this.
+func (h *Handlers) HandleRemoveSiteMember(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	userId := e.Request.PathValue("userId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleOwner) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site owners can manage members"})
+	}
+
+	member, err := h.app.FindFirstRecordByFilter("site_members", "site = {:site} && user = {:user}", dbx.Params{
+		"site": siteId,
+		"user": userId,
+	})
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Member not found"})
+	}
+
+	if h.isLastOwner(siteId, userId) {
+		return writeAPIError(e, badRequest("A site must keep at least one owner"))
+	}
+
+	err = h.app.RunInTransaction(func(txApp core.App) error {
+		if err := txApp.Delete(member); err != nil {
+			return err
+		}
+		return deleteMemberReports(txApp, siteId, userId)
+	})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// deleteMemberReports removes a former member's subscriptions to a site's
+// reports, whether linked to their account or only to their address
+func deleteMemberReports(app core.App, siteId, userId string) error {
+	filter, params := "site = {:site} && user = {:user}", dbx.Params{"site": siteId, "user": userId}
+	if user, err := app.FindRecordById("users", userId); err == nil {
+		filter = "site = {:site} && (user = {:user} || email = {:email})"
+		params["email"] = strings.ToLower(user.Email())
+	}
+
+	subscriptions, err := app.FindRecordsByFilter("report_subscriptions", filter, "", 0, 0, params)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if err := app.Delete(subscription); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLastOwner reports whether userId is the only owner of a site.
+// Sites without any owners (e.g. created by a superuser) never have a last owner.
+func (h *Handlers) isLastOwner(siteId, userId string) bool {
+	owners, err := h.app.FindRecordsByFilter("site_members", "site = {:site} && role = {:role}", "", 0, 0, dbx.Params{
+		"site": siteId,
+		"role": RoleOwner,
+	})
+	if err != nil {
+		return false
+	}
+
+	return len(owners) == 1 && owners[0].GetString("user") == userId
+}
+
+// SetSiteMember creates or updates a user's membership of a site
+func SetSiteMember(app *pocketbase.PocketBase, siteId, userId, role string) error {
+	member, err := app.FindFirstRecordByFilter("site_members", "site = {:site} && user = {:user}", dbx.Params{
+		"site": siteId,
+		"user": userId,
+	})
+	if err != nil {
+		collection, err := app.FindCollectionByNameOrId("site_members")
+		if err != nil {
+			return err
+		}
+		member = core.NewRecord(collection)
+		member.Set("site", siteId)
+		member.Set("user", userId)
+	}
+
+	member.Set("role", role)
+	return app.Save(member)
+}
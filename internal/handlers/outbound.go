@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// outboundTimeout bounds a request to a URL registered by a site editor
+const outboundTimeout = 10 * time.Second
+
+// nonPublicPrefixes are ranges that netip doesn't classify as private or
+// local but that aren't reachable on the internet either: "this network",
+// carrier-grade NAT, IETF protocol assignments and benchmarking
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// outboundClient sends webhooks and alert webhooks to the URLs that site
+// editors register. Editors aren't trusted with the server's network, so it
+// only connects to public addresses, checked after DNS resolution so a
+// rebinding host can't get around it, and it doesn't follow redirects.
+var outboundClient = &http.Client{
+	Timeout: outboundTimeout,
+	Transport: &http.Transport{
+		// Requests go straight to the checked address, never through a proxy
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: outboundTimeout,
+			Control: outboundControl,
+		}).DialContext,
+		TLSHandshakeTimeout: outboundTimeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// outboundControl refuses connections to non-public addresses. It runs
+// for every address a host resolves to, right before connecting.
+func outboundControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// isPublicAddr reports whether ip is a unicast address reachable on the
+// internet, rather than loopback, link-local, private, unspecified or multicast
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateOutboundURL checks that raw is an http(s) URL whose host resolves
+// to public addresses only. outboundClient checks again on every request, as
+// DNS can change after the URL was saved.
+func validateOutboundURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("must be an http or https URL")
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("must not point to this server")
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !isPublicAddr(ip) {
+			return errors.New("must point to a public address")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("host %s can't be resolved", host)
+	}
+	for _, ip := range ips {
+		if !isPublicAddr(ip) {
+			return errors.New("must point to a public address")
+		}
+	}
+	return nil
+}
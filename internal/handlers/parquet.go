@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/pocketbase/pocketbase"
+)
+
+// parquetRowGroupSize is how many rows are buffered before a row group is written
+const parquetRowGroupSize = 10_000
+
+// PageviewParquet is the Parquet schema of exported pageviews. Columns may be
+// added at the end, but existing ones must never be renamed, retyped or reordered
+// so warehouse tables built on earlier exports keep loading.
+type PageviewParquet struct {
+	ID           string    `parquet:"id"`
+	Site         string    `parquet:"site,dict"`
+	Created      time.Time `parquet:"created,timestamp(millisecond)"`
+	Path         string    `parquet:"path,dict"`
+	Referrer     string    `parquet:"referrer,dict"`
+	Country      string    `parquet:"country,dict"`
+	Browser      string    `parquet:"browser,dict"`
+	OS           string    `parquet:"os,dict"`
+	Device       string    `parquet:"device,dict"`
+	ScreenWidth  int32     `parquet:"screen_width"`
+	ScreenHeight int32     `parquet:"screen_height"`
+	VisitorHash  string    `parquet:"visitor_hash"`
+	UserAgent    string    `parquet:"user_agent,dict"`
+}
+
+// ParquetPartition returns the Hive-style path of the file a pageview belongs to,
+// e.g. site=abc123/date=2024-01-31/pageviews.parquet
+func ParquetPartition(site string, created time.Time) string {
+	return "site=" + site + "/date=" + created.UTC().Format(apiDateLayout) + "/pageviews.parquet"
+}
+
+// WriteParquetPartitions writes the pageviews matching q as one Parquet file
+// per site and UTC day. create is called with each partition path (see
+// ParquetPartition) and the returned writer is closed once the partition is
+// complete. It returns the number of files and rows written.
+func WriteParquetPartitions(app *pocketbase.PocketBase, q StatsQuery, create func(name string) (io.WriteCloser, error)) (int, int, error) {
+	var out io.WriteCloser
+	var writer *parquet.GenericWriter[PageviewParquet]
+	var partition string
+	buffer := make([]PageviewParquet, 0, parquetRowGroupSize)
+	files, rows := 0, 0
+
+	flush := func() error {
+		if len(buffer) == 0 {
+			return nil
+		}
+		if _, err := writer.Write(buffer); err != nil {
+			return err
+		}
+		buffer = buffer[:0]
+		return writer.Flush()
+	}
+
+	closePartition := func() error {
+		if writer == nil {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		writer = nil
+		return out.Close()
+	}
+
+	// Pageviews are streamed oldest first, so each partition is written in one go
+	err := StreamPageviews(app, q, func(pv PageviewExport) error {
+		created, err := time.Parse(time.RFC3339Nano, pv.Created)
+		if err != nil {
+			return err
+		}
+
+		if name := ParquetPartition(pv.Site, created); name != partition {
+			if err := closePartition(); err != nil {
+				return err
+			}
+			if out, err = create(name); err != nil {
+				return err
+			}
+			writer = parquet.NewGenericWriter[PageviewParquet](out, parquet.Compression(&parquet.Zstd))
+			partition = name
+			files++
+		}
+
+		buffer = append(buffer, PageviewParquet{
+			ID:           pv.ID,
+			Site:         pv.Site,
+			Created:      created,
+			Path:         pv.Path,
+			Referrer:     pv.Referrer,
+			Country:      pv.Country,
+			Browser:      pv.Browser,
+			OS:           pv.OS,
+			Device:       pv.Device,
+			ScreenWidth:  int32(pv.ScreenWidth),
+			ScreenHeight: int32(pv.ScreenHeight),
+			VisitorHash:  pv.VisitorHash,
+			UserAgent:    pv.UserAgent,
+		})
+		rows++
+
+		if len(buffer) == parquetRowGroupSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if out != nil && writer != nil {
+			out.Close()
+		}
+		return files, rows, err
+	}
+
+	return files, rows, closePartition()
+}
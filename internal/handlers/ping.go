@@ -1,24 +1,34 @@
 package handlers
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 
+	"github.com/abigpotostew/dingdong/internal/logging"
+	"github.com/abigpotostew/dingdong/internal/metrics"
+
 	"github.com/pocketbase/pocketbase/core"
 )
 
+var (
+	pingLog   = logging.Component("ping")
+	deniedLog = logging.Component("denied")
+)
+
 // PingRequest represents the incoming ping data from the tracker
 type PingRequest struct {
 	Path         string `json:"path"`
 	Referrer     string `json:"referrer"`
 	ScreenWidth  int    `json:"screen_width"`
 	ScreenHeight int    `json:"screen_height"`
+	GPC          bool   `json:"gpc"`
 }
 
 // setCORSHeaders sets the CORS headers for the ping endpoint
@@ -46,6 +56,7 @@ func (h *Handlers) HandlePingPreflight(e *core.RequestEvent) error {
 	// Look up the site by domain (checks primary domain and additional_domains)
 	_, err = FindSiteByDomain(h.app, domain)
 	if err != nil {
+		CountPing(nil, metrics.PingDenied, "cors_preflight_denied")
 		h.RecordDeniedPageview(e, domain, origin, "cors_preflight_denied", nil)
 		return e.NoContent(http.StatusForbidden)
 	}
@@ -54,6 +65,23 @@ func (h *Handlers) HandlePingPreflight(e *core.RequestEvent) error {
 	return e.NoContent(http.StatusNoContent)
 }
 
+// CountPing counts a ping in the metrics. Unregistered domains share one site label.
+func CountPing(site *core.Record, outcome, reason string) {
+	label := metrics.UnknownSite
+	if site != nil {
+		label = site.GetString("domain")
+	}
+	metrics.Pings.Inc(label, outcome, reason)
+}
+
+// logPing writes a routine ping log line. Busy sites send a lot of pings, so
+// these are sampled by LOG_PING_SAMPLE. Errors are logged with pingLog directly.
+func logPing(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if logging.SamplePing() {
+		pingLog.Log(ctx, level, msg, args...)
+	}
+}
+
 // DeniedPageviewData holds optional data for denied pageview logging
 type DeniedPageviewData struct {
 	Path         string
@@ -66,7 +94,7 @@ type DeniedPageviewData struct {
 func (h *Handlers) RecordDeniedPageview(e *core.RequestEvent, domain, origin, reason string, data *DeniedPageviewData) {
 	collection, err := h.app.FindCollectionByNameOrId("denied_pageviews")
 	if err != nil {
-		log.Printf("[denied] Failed to find denied_pageviews collection: %v\n", err)
+		deniedLog.ErrorContext(e.Request.Context(), "Failed to find denied_pageviews collection", "error", err)
 		return
 	}
 
@@ -89,18 +117,21 @@ func (h *Handlers) RecordDeniedPageview(e *core.RequestEvent, domain, origin, re
 	}
 
 	if err := h.app.Save(record); err != nil {
-		log.Printf("[denied] Failed to save denied pageview: %v\n", err)
+		deniedLog.ErrorContext(e.Request.Context(), "Failed to save denied pageview", "error", err)
 		return
 	}
 
-	log.Printf("[denied] Recorded denied pageview from %s (reason: %s)\n", domain, reason)
+	deniedLog.DebugContext(e.Request.Context(), "Recorded denied pageview", "domain", domain, "reason", reason)
 }
 
 // HandlePing processes incoming pageview pings from the JavaScript tracker
 func (h *Handlers) HandlePing(e *core.RequestEvent) error {
+	ctx := e.Request.Context()
+
 	origin := e.Request.Header.Get("Origin")
 	if origin == "" {
-		log.Println("[ping] Missing Origin header")
+		logPing(ctx, slog.LevelWarn, "Missing Origin header")
+		CountPing(nil, metrics.PingInvalid, "missing_origin")
 		return e.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Missing Origin header",
 		})
@@ -108,7 +139,8 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 
 	parsedOrigin, err := url.Parse(origin)
 	if err != nil {
-		log.Printf("[ping] Invalid Origin header: %s, error: %v\n", origin, err)
+		logPing(ctx, slog.LevelWarn, "Invalid Origin header", "origin", origin, "error", err)
+		CountPing(nil, metrics.PingInvalid, "invalid_origin")
 		return e.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Invalid Origin header",
 		})
@@ -118,7 +150,8 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 	// Read body first so we can log it for denied requests
 	body, err := io.ReadAll(e.Request.Body)
 	if err != nil {
-		log.Printf("[ping] Failed to read body: %v\n", err)
+		logPing(ctx, slog.LevelWarn, "Failed to read body", "domain", domain, "error", err)
+		CountPing(nil, metrics.PingInvalid, "read_error")
 		return e.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Failed to read request body",
 		})
@@ -132,7 +165,8 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 
 	site, err := FindSiteByDomain(h.app, domain)
 	if err != nil {
-		log.Printf("[ping] Domain not registered: %s\n", domain)
+		logPing(ctx, slog.LevelWarn, "Domain not registered", "domain", domain)
+		CountPing(nil, metrics.PingDenied, "domain_not_registered")
 		h.RecordDeniedPageview(e, domain, origin, "domain_not_registered", &DeniedPageviewData{
 			Path:         req.Path,
 			Referrer:     req.Referrer,
@@ -145,7 +179,8 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 	}
 
 	if site == nil {
-		log.Printf("[ping] Site not found: %s\n", domain)
+		logPing(ctx, slog.LevelWarn, "Site not found", "domain", domain)
+		CountPing(nil, metrics.PingDenied, "site_not_found")
 		h.RecordDeniedPageview(e, domain, origin, "site_not_found", &DeniedPageviewData{
 			Path:         req.Path,
 			Referrer:     req.Referrer,
@@ -157,27 +192,89 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 		})
 	}
 
+	// Token-authenticated ingestion is limited to the token's sites
+	if token, ok := e.Get(APITokenKey).(*core.Record); ok && !TokenAllowsSite(token, site.Id) {
+		logPing(ctx, slog.LevelWarn, "API token not allowed for site", "domain", domain, "token", token.Id)
+		CountPing(site, metrics.PingDenied, "token_site_denied")
+		h.RecordDeniedPageview(e, domain, origin, "token_site_denied", &DeniedPageviewData{
+			Path:         req.Path,
+			Referrer:     req.Referrer,
+			ScreenWidth:  req.ScreenWidth,
+			ScreenHeight: req.ScreenHeight,
+		})
+		return e.JSON(http.StatusForbidden, map[string]string{
+			"error": "API token is not allowed to access this site",
+		})
+	}
+
 	if len(body) == 0 {
-		log.Println("[ping] Empty request body")
+		logPing(ctx, slog.LevelWarn, "Empty request body", "domain", domain)
+		CountPing(site, metrics.PingInvalid, "empty_body")
 		return e.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Empty request body",
 		})
 	}
 
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Printf("[ping] Failed to parse JSON body: %v, body: %s\n", err, string(body))
+		logPing(ctx, slog.LevelWarn, "Invalid JSON body", "domain", domain, "error", err, "body", logging.Body(body))
+		CountPing(site, metrics.PingInvalid, "invalid_json")
 		return e.JSON(http.StatusBadRequest, map[string]string{
 			"error": "Invalid JSON in request body",
 		})
 	}
 
-	userAgent := e.Request.Header.Get("User-Agent")
+	// Reject or flag referrer spam depending on the site setting
+	isSpam := IsReferrerSpam(req.Referrer, site.GetString("referrer_blocklist"))
+	if isSpam && site.GetString("referrer_spam_action") != "flag" {
+		logPing(ctx, slog.LevelInfo, "Blocked referrer spam", "domain", domain, "referrer_host", referrerHost(req.Referrer))
+		CountPing(site, metrics.PingDenied, "referrer_spam")
+		h.RecordDeniedPageview(e, domain, origin, "referrer_spam", &DeniedPageviewData{
+			Path:         req.Path,
+			Referrer:     req.Referrer,
+			ScreenWidth:  req.ScreenWidth,
+			ScreenHeight: req.ScreenHeight,
+		})
+		return e.JSON(http.StatusForbidden, map[string]string{
+			"error": "Referrer blocked",
+		})
+	}
+
+	// Skip the site owners' own traffic before the IP is hashed
 	clientIP := getRealClientIP(e)
+	if IsExcludedIP(clientIP, site.GetString("excluded_ips")) {
+		logPing(ctx, slog.LevelInfo, "Ignored pageview from excluded IP", "domain", domain)
+		CountPing(site, metrics.PingIgnored, "excluded_ip")
+		return e.JSON(http.StatusOK, map[string]string{
+			"status": "ignored",
+		})
+	}
+
+	userAgent := e.Request.Header.Get("User-Agent")
 	ipHash := hashIP(clientIP)
+	country := getCountry(e)
+
+	// Honor Do Not Track / Global Privacy Control if the site opted in
+	if mode := site.GetString("privacy_signals"); mode != "" && mode != PrivacySignalsIgnore && hasPrivacySignal(e, req) {
+		if mode == PrivacySignalsDrop {
+			h.recordOptOut(site.Id, true)
+			CountPing(site, metrics.PingIgnored, "privacy_signal")
+			return e.JSON(http.StatusOK, map[string]string{
+				"status": "ignored",
+			})
+		}
+
+		// Anonymize: keep the pageview but nothing that identifies the visitor
+		h.recordOptOut(site.Id, false)
+		userAgent = ""
+		ipHash = ""
+		req.ScreenWidth = 0
+		req.ScreenHeight = 0
+	}
 
 	collection, err := h.app.FindCollectionByNameOrId("pageviews")
 	if err != nil {
-		log.Printf("[ping] Failed to find pageviews collection: %v\n", err)
+		pingLog.ErrorContext(ctx, "Failed to find pageviews collection", "error", err)
+		CountPing(site, metrics.PingError, "collection_missing")
 		return e.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Internal error",
 		})
@@ -187,19 +284,45 @@ func (h *Handlers) HandlePing(e *core.RequestEvent) error {
 	record.Set("site", site.Id)
 	record.Set("path", req.Path)
 	record.Set("referrer", req.Referrer)
+	record.Set("referrer_source", referrerHost(req.Referrer))
 	record.Set("user_agent", userAgent)
 	record.Set("ip_hash", ipHash)
+	record.Set("country", country)
 	record.Set("screen_width", req.ScreenWidth)
 	record.Set("screen_height", req.ScreenHeight)
+	record.Set("spam", isSpam)
+
+	uaInfo := ParseUserAgent(userAgent)
+	record.Set("browser", uaInfo.Browser)
+	record.Set("os", uaInfo.OS)
+	record.Set("device", uaInfo.Device)
+
+	utm := ParseUTM(req.Path)
+	record.Set("utm_source", utm.Source)
+	record.Set("utm_medium", utm.Medium)
+	record.Set("utm_campaign", utm.Campaign)
 
 	if err := h.app.Save(record); err != nil {
-		log.Printf("[ping] Failed to save pageview: %v\n", err)
+		pingLog.ErrorContext(ctx, "Failed to save pageview", "domain", domain, "error", err)
+		CountPing(site, metrics.PingError, "save_failed")
 		return e.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to record pageview",
 		})
 	}
 
-	log.Printf("[ping] Recorded pageview for %s: %s\n", domain, req.Path)
+	// Spam isn't shown live or counted as a current visitor, and webhooks
+	// are matched and sent by the background worker
+	if !isSpam {
+		h.live.Publish(site.Id, ipHash, LivePageview{
+			Path:      req.Path,
+			Referrer:  req.Referrer,
+			CreatedAt: record.GetDateTime("created").Time(),
+		})
+		h.hooks.Enqueue(site, record)
+	}
+
+	CountPing(site, metrics.PingAccepted, "")
+	logPing(ctx, slog.LevelInfo, "Recorded pageview", "domain", domain, "path", logging.Path(req.Path))
 	return e.JSON(http.StatusOK, map[string]string{
 		"status": "ok",
 	})
@@ -225,6 +348,18 @@ func getRealClientIP(e *core.RequestEvent) string {
 	return e.RealIP()
 }
 
+// getCountry returns the visitor's ISO country code as set by a CDN or proxy in front of DingDong
+func getCountry(e *core.RequestEvent) string {
+	for _, header := range []string{"CF-IPCountry", "CloudFront-Viewer-Country", "X-Vercel-IP-Country", "X-Country-Code"} {
+		country := strings.ToUpper(strings.TrimSpace(e.Request.Header.Get(header)))
+		// Cloudflare uses XX for unknown and T1 for Tor
+		if country != "" && country != "XX" && country != "T1" {
+			return country
+		}
+	}
+	return ""
+}
+
 // hashIP creates a privacy-preserving hash of the IP address
 func hashIP(ip string) string {
 	hash := sha256.Sum256([]byte(ip + "-dingdong"))
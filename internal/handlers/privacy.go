@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var privacyLog = logging.Component("privacy")
+
+// Privacy signal modes for the sites.privacy_signals field
+const (
+	PrivacySignalsIgnore    = "ignore"
+	PrivacySignalsDrop      = "drop"
+	PrivacySignalsAnonymize = "anonymize"
+)
+
+// hasPrivacySignal reports whether the visitor asked not to be tracked via
+// the Do Not Track or Global Privacy Control headers, or the tracker's GPC flag
+func hasPrivacySignal(e *core.RequestEvent, req PingRequest) bool {
+	if e.Request.Header.Get("DNT") == "1" {
+		return true
+	}
+	if e.Request.Header.Get("Sec-GPC") == "1" {
+		return true
+	}
+	return req.GPC
+}
+
+// recordOptOut increments the daily aggregate counter of opted-out pings for a site.
+// Only the count is stored, never anything about the visitor.
+func (h *Handlers) recordOptOut(siteId string, dropped bool) {
+	column := "anonymized"
+	if dropped {
+		column = "dropped"
+	}
+
+	// Upsert in a single statement so concurrent pings don't race on the unique (site, day) index
+	_, err := h.app.DB().
+		NewQuery("INSERT INTO privacy_optouts (site, day, " + column + ", created, updated) VALUES ({:siteId}, {:day}, 1, {:now}, {:now}) " +
+			"ON CONFLICT(site, day) DO UPDATE SET " + column + " = " + column + " + 1, updated = {:now}").
+		Bind(map[string]any{
+			"siteId": siteId,
+			"day":    time.Now().UTC().Format("2006-01-02"),
+			"now":    time.Now().UTC().Format("2006-01-02 15:04:05.000Z"),
+		}).
+		Execute()
+	if err != nil {
+		privacyLog.Error("Failed to record opt-out", "site", siteId, "error", err)
+	}
+}
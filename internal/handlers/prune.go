@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+)
+
+// PruneResult counts the rows deleted by PruneOldData, or that would be on a dry run
+type PruneResult struct {
+	Pageviews int64
+	Denied    int64
+}
+
+// PruneOldData deletes pageviews created before the cutoff, for one site or
+// all of them. Denied pageviews aren't linked to a site, so they are only
+// pruned along with all sites.
+func PruneOldData(app *pocketbase.PocketBase, siteId string, before time.Time, dryRun bool) (PruneResult, error) {
+	var result PruneResult
+
+	where := "created < {:before}"
+	params := dbx.Params{"before": before.UTC().Format(dbTimeLayout)}
+	if siteId != "" {
+		where += " AND site = {:siteId}"
+		params["siteId"] = siteId
+	}
+
+	var err error
+	if result.Pageviews, err = pruneTable(app, "pageviews", where, params, dryRun); err != nil {
+		return result, err
+	}
+	if !dryRun {
+		if err := pruneHourly(app, siteId, before); err != nil {
+			return result, err
+		}
+	}
+
+	if siteId == "" {
+		if result.Denied, err = pruneTable(app, "denied_pageviews", where, params, dryRun); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// pruneTable deletes (or counts on a dry run) the rows of table matching where
+func pruneTable(app *pocketbase.PocketBase, table, where string, params dbx.Params, dryRun bool) (int64, error) {
+	if dryRun {
+		var count struct {
+			Count int64 `db:"count"`
+		}
+		err := app.DB().
+			NewQuery("SELECT COUNT(*) as count FROM " + table + " WHERE " + where).
+			Bind(params).
+			One(&count)
+		return count.Count, err
+	}
+
+	res, err := app.DB().
+		NewQuery("DELETE FROM " + table + " WHERE " + where).
+		Bind(params).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// pruneHourly drops the hourly counters of the pruned hours, and recounts the
+// hour the cutoff falls in
+func pruneHourly(app *pocketbase.PocketBase, siteId string, before time.Time) error {
+	hour := before.UTC().Truncate(time.Hour)
+
+	where := "hour < {:hour}"
+	params := dbx.Params{"hour": hour.Format(dbTimeLayout)}
+	if siteId != "" {
+		where += " AND site = {:siteId}"
+		params["siteId"] = siteId
+	}
+	if _, err := pruneTable(app, "pageview_hourly", where, params, false); err != nil {
+		return err
+	}
+	InvalidateStatsCache(app, siteId)
+
+	if hour.Equal(before) {
+		return nil
+	}
+	return RebuildHourly(app, siteId, hour, hour.Add(time.Hour))
+}
+
+// PruneRetention applies each site's retention_days, deleting older pageviews
+func PruneRetention(app *pocketbase.PocketBase) (int64, error) {
+	sites, err := app.FindRecordsByFilter("sites", "retention_days > 0", "", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var total int64
+	for _, site := range sites {
+		result, err := PruneOldData(app, site.Id, today.AddDate(0, 0, -site.GetInt("retention_days")), false)
+		if err != nil {
+			return total, err
+		}
+		total += result.Pageviews
+	}
+
+	return total, nil
+}
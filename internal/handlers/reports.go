@@ -0,0 +1,814 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+var reportsLog = logging.Component("reports")
+
+// Report frequencies
+const (
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+// ReportFrequencies lists every email report frequency
+var ReportFrequencies = []string{ReportWeekly, ReportMonthly}
+
+// reportSendHour is the hour, in the site's timezone, after which the report
+// of a period that just ended is sent
+const reportSendHour = 7
+
+// reportTopItems is how many pages and referrers a report lists
+const reportTopItems = 5
+
+// Signed links in site report emails, which work without signing in
+const (
+	ReportLinkConfirm     = "confirm"
+	ReportLinkUnsubscribe = "unsubscribe"
+)
+
+// reportSecretLength is the length of the key that signs a subscription's links
+const reportSecretLength = 32
+
+// ReportEmailData is passed to report_email.html
+type ReportEmailData struct {
+	SiteName        string
+	Domain          string
+	Frequency       string
+	Period          string
+	Pageviews       int
+	Visitors        int
+	PageviewsChange string // e.g. "+12%", empty if the previous period had no pageviews
+	VisitorsChange  string
+	TopPages        []BreakdownItem
+	TopReferrers    []BreakdownItem
+	DashboardURL    string
+	UnsubscribeURL  string // signed link of the subscription, empty for test reports
+}
+
+// ReportConfirmData is passed to report_confirm_email.html
+type ReportConfirmData struct {
+	SiteName   string
+	Domain     string
+	Frequency  string
+	ConfirmURL string
+}
+
+// ReportLinkData is passed to report_link.html
+type ReportLinkData struct {
+	Action    string // ReportLinkConfirm or ReportLinkUnsubscribe
+	SiteName  string
+	Email     string
+	Frequency string
+	Done      bool
+	Error     string
+}
+
+// UserReportData is passed to user_report_email.html, with the report of
+// every site the recipient can view, busiest first
+type UserReportData struct {
+	Frequency    string
+	Period       string
+	Sites        []ReportEmailData
+	DashboardURL string
+}
+
+// ReportSubscription is a report subscription as returned by the report endpoints
+type ReportSubscription struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Frequency string `json:"frequency"`
+	Confirmed bool   `json:"confirmed"` // false until an address without an account confirms
+	LastSent  string `json:"last_sent"`
+	Created   string `json:"created"`
+}
+
+// ReportSubscriptionRequest is the body of the subscribe and test-send endpoints.
+// Email defaults to the signed-in user's address.
+type ReportSubscriptionRequest struct {
+	Email     string `json:"email"`
+	Frequency string `json:"frequency"`
+}
+
+// SiteLocation returns the site's timezone, or UTC if it has none
+func SiteLocation(site *core.Record) *time.Location {
+	if loc, err := time.LoadLocation(site.GetString("timezone")); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// ReportPeriod returns the last complete week (Monday to Sunday) or calendar
+// month before now, in loc. to is exclusive.
+func ReportPeriod(frequency string, now time.Time, loc *time.Location) (from, to time.Time) {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	if frequency == ReportMonthly {
+		to = today.AddDate(0, 0, 1-today.Day())
+		return to.AddDate(0, -1, 0), to
+	}
+
+	to = today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	return to.AddDate(0, 0, -7), to
+}
+
+// reportPeriodLabel formats a period for the email subject and heading
+func reportPeriodLabel(frequency string, from, to time.Time) string {
+	if frequency == ReportMonthly {
+		return from.Format("January 2006")
+	}
+	return from.Format("Jan 2") + " – " + to.AddDate(0, 0, -1).Format("Jan 2, 2006")
+}
+
+// formatChange formats the change from previous to current as a percentage
+func formatChange(current, previous int) string {
+	if previous == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%+.0f%%", float64(current-previous)*100/float64(previous))
+}
+
+// reportBaseURL returns the URL links in emails point to. There is no request
+// to detect it from, so it's PUBLIC_URL or the PocketBase application URL.
+func reportBaseURL(app *pocketbase.PocketBase) string {
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	return strings.TrimSuffix(app.Settings().Meta.AppURL, "/")
+}
+
+// BuildReport loads a site's stats for the last complete period before now,
+// compared with the period before it
+func BuildReport(app *pocketbase.PocketBase, site *core.Record, frequency string, now time.Time) (ReportEmailData, error) {
+	return buildReport(app, site, frequency, now, SiteLocation(site))
+}
+
+// BuildUserReport loads the report of every active site auth can view. The
+// sites may be in different timezones, so the period is in UTC to be the
+// same for all of them.
+func BuildUserReport(app *pocketbase.PocketBase, auth *core.Record, frequency string, now time.Time) (UserReportData, error) {
+	from, to := ReportPeriod(frequency, now, time.UTC)
+	data := UserReportData{
+		Frequency:    frequency,
+		Period:       reportPeriodLabel(frequency, from, to),
+		DashboardURL: reportBaseURL(app) + "/",
+	}
+
+	sites, err := VisibleSites(app, auth)
+	if err != nil {
+		return data, err
+	}
+
+	for _, site := range sites {
+		if !site.GetBool("active") {
+			continue
+		}
+		report, err := buildReport(app, site, frequency, now, time.UTC)
+		if err != nil {
+			return data, err
+		}
+		data.Sites = append(data.Sites, report)
+	}
+
+	slices.SortStableFunc(data.Sites, func(a, b ReportEmailData) int {
+		return b.Pageviews - a.Pageviews
+	})
+	return data, nil
+}
+
+func buildReport(app *pocketbase.PocketBase, site *core.Record, frequency string, now time.Time, loc *time.Location) (ReportEmailData, error) {
+	from, to := ReportPeriod(frequency, now, loc)
+	previousFrom := from.AddDate(0, 0, -7)
+	if frequency == ReportMonthly {
+		previousFrom = from.AddDate(0, -1, 0)
+	}
+
+	data := ReportEmailData{
+		SiteName:     site.GetString("name"),
+		Domain:       site.GetString("domain"),
+		Frequency:    frequency,
+		Period:       reportPeriodLabel(frequency, from, to),
+		DashboardURL: reportBaseURL(app) + "/sites/" + site.Id,
+	}
+
+	q := StatsQuery{SiteID: site.Id, From: from, To: to}
+	current, err := QueryAggregate(app, q)
+	if err != nil {
+		return data, err
+	}
+	previous, err := QueryAggregate(app, StatsQuery{SiteID: site.Id, From: previousFrom, To: from})
+	if err != nil {
+		return data, err
+	}
+
+	data.Pageviews = current.Pageviews
+	data.Visitors = current.Visitors
+	data.PageviewsChange = formatChange(current.Pageviews, previous.Pageviews)
+	data.VisitorsChange = formatChange(current.Visitors, previous.Visitors)
+
+	if data.TopPages, err = QueryBreakdown(app, q, "path", reportTopItems, 0); err != nil {
+		return data, err
+	}
+	if data.TopReferrers, err = QueryBreakdown(app, q, "referrer", reportTopItems, 0); err != nil {
+		return data, err
+	}
+
+	return data, nil
+}
+
+// sendReport renders a site report and emails it with the PocketBase mail settings
+func (h *Handlers) sendReport(data ReportEmailData, email string) error {
+	subject := fmt.Sprintf("%s %s report: %s", data.SiteName, data.Frequency, data.Period)
+	return h.sendReportEmail("report_email.html", subject, data, email, data.UnsubscribeURL)
+}
+
+// sendUserReport renders a per-user report and emails it
+func (h *Handlers) sendUserReport(data UserReportData, email string) error {
+	subject := fmt.Sprintf("DingDong %s report: %s", data.Frequency, data.Period)
+	return h.sendReportEmail("user_report_email.html", subject, data, email, "")
+}
+
+// sendReportConfirmation asks the recipient of a new subscription to confirm it
+func (h *Handlers) sendReportConfirmation(site, subscription *core.Record) error {
+	data := ReportConfirmData{
+		SiteName:   site.GetString("name"),
+		Domain:     site.GetString("domain"),
+		Frequency:  subscription.GetString("frequency"),
+		ConfirmURL: reportLinkURL(h.app, subscription, ReportLinkConfirm),
+	}
+	subject := fmt.Sprintf("Confirm the %s %s report", data.SiteName, data.Frequency)
+	return h.sendReportEmail("report_confirm_email.html", subject, data, subscription.GetString("email"), "")
+}
+
+// sendReportEmail renders and sends a report email. With an unsubscribeURL,
+// mail clients can also offer one-click unsubscribe (RFC 8058).
+func (h *Handlers) sendReportEmail(template, subject string, data any, email, unsubscribeURL string) error {
+	var body bytes.Buffer
+	if err := h.tmpl.ExecuteTemplate(&body, template, data); err != nil {
+		return err
+	}
+
+	settings := h.app.Settings()
+	message := &mailer.Message{
+		From:    mail.Address{Name: settings.Meta.SenderName, Address: settings.Meta.SenderAddress},
+		To:      []mail.Address{{Address: email}},
+		Subject: subject,
+		HTML:    body.String(),
+	}
+	if unsubscribeURL != "" {
+		message.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+	return h.app.NewMailClient().Send(message)
+}
+
+// reportLinkSignature signs an action on a subscription with its secret, so a
+// link can't be changed to act on another subscription
+func reportLinkSignature(subscription *core.Record, action string) string {
+	mac := hmac.New(sha256.New, []byte(subscription.GetString("secret")))
+	mac.Write([]byte(action + ":" + subscription.Id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reportLinkURL returns the signed confirmation or unsubscribe link of a subscription
+func reportLinkURL(app *pocketbase.PocketBase, subscription *core.Record, action string) string {
+	query := url.Values{"id": {subscription.Id}, "sig": {reportLinkSignature(subscription, action)}}
+	return reportBaseURL(app) + "/reports/" + action + "?" + query.Encode()
+}
+
+// reportDue returns the end of the subscription's last complete period in
+// loc, and whether its report is due: the period ended reportSendHour ago
+// and wasn't sent yet
+func reportDue(subscription *core.Record, now time.Time, loc *time.Location) (time.Time, bool) {
+	_, to := ReportPeriod(subscription.GetString("frequency"), now, loc)
+	if now.Before(to.Add(reportSendHour * time.Hour)) {
+		return to, false
+	}
+	if lastSent := subscription.GetDateTime("last_sent"); !lastSent.IsZero() && !lastSent.Time().Before(to) {
+		return to, false
+	}
+	return to, true
+}
+
+// SendDueReports emails every subscription whose period has ended since it
+// was last sent. It runs hourly, so reports go out shortly after reportSendHour
+// in each site's timezone (UTC for per-user reports) and are caught up after
+// downtime.
+func (h *Handlers) SendDueReports() {
+	now := time.Now()
+	h.sendDueSiteReports(now)
+	h.sendDueUserReports(now)
+}
+
+func (h *Handlers) sendDueSiteReports(now time.Time) {
+	subscriptions, err := h.app.FindRecordsByFilter("report_subscriptions", "confirmed = true", "site", 0, 0)
+	if err != nil {
+		reportsLog.Error("Failed to load subscriptions", "error", err)
+		return
+	}
+
+	sites := map[string]*core.Record{}
+	reports := map[string]ReportEmailData{}
+
+	for _, subscription := range subscriptions {
+		siteId := subscription.GetString("site")
+		site, ok := sites[siteId]
+		if !ok {
+			site, _ = h.app.FindRecordById("sites", siteId)
+			sites[siteId] = site
+		}
+		if site == nil || !site.GetBool("active") {
+			continue
+		}
+
+		frequency := subscription.GetString("frequency")
+		to, due := reportDue(subscription, now, SiteLocation(site))
+		if !due {
+			continue
+		}
+
+		// Subscriptions of accounts that can no longer view the site are
+		// skipped, in case one outlived the account's membership
+		if userId := subscription.GetString("user"); userId != "" {
+			user, err := h.app.FindRecordById("users", userId)
+			if err != nil || !HasSiteRole(h.app, user, siteId, RoleViewer) {
+				continue
+			}
+		}
+
+		key := siteId + "/" + frequency
+		report, ok := reports[key]
+		if !ok {
+			if report, err = BuildReport(h.app, site, frequency, now); err != nil {
+				reportsLog.Error("Failed to build report", "frequency", frequency, "domain", site.GetString("domain"), "error", err)
+				continue
+			}
+			reports[key] = report
+		}
+
+		report.UnsubscribeURL = reportLinkURL(h.app, subscription, ReportLinkUnsubscribe)
+		if err := h.sendReport(report, subscription.GetString("email")); err != nil {
+			reportsLog.Error("Failed to send report", "frequency", frequency, "domain", site.GetString("domain"), "subscription", subscription.Id, "error", err)
+			continue
+		}
+
+		subscription.Set("last_sent", to)
+		if err := h.app.Save(subscription); err != nil {
+			reportsLog.Error("Failed to save subscription", "subscription", subscription.Id, "error", err)
+		}
+	}
+}
+
+func (h *Handlers) sendDueUserReports(now time.Time) {
+	subscriptions, err := h.app.FindRecordsByFilter("user_report_subscriptions", "1=1", "", 0, 0)
+	if err != nil {
+		reportsLog.Error("Failed to load user subscriptions", "error", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		to, due := reportDue(subscription, now, time.UTC)
+		if !due {
+			continue
+		}
+
+		auth, err := h.userReportRecipient(subscription)
+		if err != nil {
+			reportsLog.Error("Failed to find report recipient", "subscription", subscription.Id, "error", err)
+			continue
+		}
+
+		frequency := subscription.GetString("frequency")
+		report, err := BuildUserReport(h.app, auth, frequency, now)
+		if err != nil {
+			reportsLog.Error("Failed to build user report", "frequency", frequency, "subscription", subscription.Id, "error", err)
+			continue
+		}
+
+		// Nothing to report until the recipient can view a site
+		if len(report.Sites) > 0 {
+			if err := h.sendUserReport(report, auth.Email()); err != nil {
+				reportsLog.Error("Failed to send user report", "frequency", frequency, "subscription", subscription.Id, "error", err)
+				continue
+			}
+		}
+
+		subscription.Set("last_sent", to)
+		if err := h.app.Save(subscription); err != nil {
+			reportsLog.Error("Failed to save subscription", "subscription", subscription.Id, "error", err)
+		}
+	}
+}
+
+// userReportRecipient returns the user or superuser of a per-user subscription
+func (h *Handlers) userReportRecipient(subscription *core.Record) (*core.Record, error) {
+	if superuserId := subscription.GetString("superuser"); superuserId != "" {
+		return h.app.FindRecordById(core.CollectionNameSuperusers, superuserId)
+	}
+	return h.app.FindRecordById("users", subscription.GetString("user"))
+}
+
+// userReportField is the user_report_subscriptions relation that links auth
+func userReportField(auth *core.Record) string {
+	if auth.IsSuperuser() {
+		return "superuser"
+	}
+	return "user"
+}
+
+// parseReportRequest decodes a subscription request and checks auth may use
+// its address. Viewers can only subscribe themselves; editors and owners can
+// add anyone.
+func (h *Handlers) parseReportRequest(e *core.RequestEvent, siteId string) (ReportSubscriptionRequest, error) {
+	var req ReportSubscriptionRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return req, badRequest("Invalid JSON body")
+	}
+
+	if !slices.Contains(ReportFrequencies, req.Frequency) {
+		return req, badRequest("frequency must be one of: " + strings.Join(ReportFrequencies, ", "))
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email == "" {
+		req.Email = strings.ToLower(e.Auth.Email())
+	}
+	if _, err := mail.ParseAddress(req.Email); err != nil {
+		return req, badRequest("Invalid email address")
+	}
+
+	if !strings.EqualFold(req.Email, e.Auth.Email()) && !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return req, &apiError{status: http.StatusForbidden, message: "Viewers can only subscribe their own email address"}
+	}
+
+	return req, nil
+}
+
+// HandleListReports lists a site's email report subscriptions. Editors and
+// owners see all of them, viewers only their own.
+func (h *Handlers) HandleListReports(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Not a member of this site"})
+	}
+
+	filter, params := "site = {:site}", dbx.Params{"site": siteId}
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		filter += " && email = {:email}"
+		params["email"] = strings.ToLower(e.Auth.Email())
+	}
+
+	subscriptions, err := h.app.FindRecordsByFilter("report_subscriptions", filter, "email,frequency", 0, 0, params)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]ReportSubscription, len(subscriptions))
+	for i, subscription := range subscriptions {
+		result[i] = toReportSubscription(subscription)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleCreateReport subscribes an address to a site's weekly or monthly report.
+// Subscribing an address twice returns the existing subscription.
+func (h *Handlers) HandleCreateReport(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Not a member of this site"})
+	}
+
+	req, err := h.parseReportRequest(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	site, err := h.app.FindRecordById("sites", siteId)
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Site not found"})
+	}
+
+	subscription, err := h.app.FindFirstRecordByFilter("report_subscriptions", "site = {:site} && email = {:email} && frequency = {:frequency}", dbx.Params{
+		"site":      siteId,
+		"email":     req.Email,
+		"frequency": req.Frequency,
+	})
+	if err != nil {
+		collection, err := h.app.FindCollectionByNameOrId("report_subscriptions")
+		if err != nil {
+			return writeAPIError(e, err)
+		}
+
+		subscription = core.NewRecord(collection)
+		subscription.Set("site", siteId)
+		subscription.Set("email", req.Email)
+		subscription.Set("frequency", req.Frequency)
+		subscription.Set("secret", security.RandomString(reportSecretLength))
+		if user := h.reportAccount(e.Auth, siteId, req.Email); user != nil {
+			subscription.Set("user", user.Id)
+			subscription.Set("confirmed", true)
+		} else {
+			subscription.Set("confirmed", strings.EqualFold(req.Email, e.Auth.Email()))
+		}
+
+		if err := h.app.Save(subscription); err != nil {
+			return writeAPIError(e, err)
+		}
+	}
+
+	// Subscribing a pending address again sends a new confirmation email
+	if !subscription.GetBool("confirmed") {
+		if err := h.sendReportConfirmation(site, subscription); err != nil {
+			reportsLog.WarnContext(e.Request.Context(), "Failed to send report confirmation", "site", siteId, "error", err)
+			return writeAPIError(e, &apiError{status: http.StatusBadGateway, message: "Failed to send the confirmation email, check the mail settings: " + err.Error()})
+		}
+	}
+
+	return e.JSON(http.StatusOK, toReportSubscription(subscription))
+}
+
+// reportAccount returns the user a site report address belongs to, if it's
+// the signed-in user or a user who can view the site. Those can manage their
+// subscriptions in the admin panel; any other address only gets reports once
+// its recipient confirms them.
+func (h *Handlers) reportAccount(auth *core.Record, siteId, email string) *core.Record {
+	if auth.Collection().Name == "users" && strings.EqualFold(email, auth.Email()) {
+		return auth
+	}
+	user, err := h.app.FindAuthRecordByEmail("users", email)
+	if err != nil || !HasSiteRole(h.app, user, siteId, RoleViewer) {
+		return nil
+	}
+	return user
+}
+
+// HandleDeleteReport unsubscribes an address. Editors and owners can remove
+// any subscription, viewers only their own.
+func (h *Handlers) HandleDeleteReport(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Not a member of this site"})
+	}
+
+	subscription, err := h.app.FindFirstRecordByFilter("report_subscriptions", "id = {:id} && site = {:site}", dbx.Params{
+		"id":   e.Request.PathValue("reportId"),
+		"site": siteId,
+	})
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Subscription not found"})
+	}
+
+	if !strings.EqualFold(subscription.GetString("email"), e.Auth.Email()) && !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Viewers can only unsubscribe their own email address"})
+	}
+
+	if err := h.app.Delete(subscription); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// HandleTestReport sends the report for the last complete period right away,
+// without touching any subscription
+func (h *Handlers) HandleTestReport(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleViewer) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Not a member of this site"})
+	}
+
+	req, err := h.parseReportRequest(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	// Like scheduled reports, test reports only go to addresses that asked for them
+	if !strings.EqualFold(req.Email, e.Auth.Email()) && h.reportAccount(e.Auth, siteId, req.Email) == nil {
+		_, err := h.app.FindFirstRecordByFilter("report_subscriptions", "site = {:site} && email = {:email} && confirmed = true", dbx.Params{
+			"site":  siteId,
+			"email": req.Email,
+		})
+		if err != nil {
+			return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Test reports can only be sent to members and confirmed subscribers"})
+		}
+	}
+
+	site, err := h.app.FindRecordById("sites", siteId)
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Site not found"})
+	}
+
+	report, err := BuildReport(h.app, site, req.Frequency, time.Now())
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	if err := h.sendReport(report, req.Email); err != nil {
+		reportsLog.WarnContext(e.Request.Context(), "Failed to send test report", "site", siteId, "error", err)
+		return writeAPIError(e, &apiError{status: http.StatusBadGateway, message: "Failed to send email, check the mail settings: " + err.Error()})
+	}
+
+	return e.JSON(http.StatusOK, map[string]string{"sent_to": req.Email})
+}
+
+// HandleReportLink shows the page of a signed confirmation or unsubscribe
+// link from a site report email, and applies it when the page's button is
+// posted. Mail scanners open links in emails, so GET never changes anything.
+// Mail clients post to the unsubscribe link directly for one-click unsubscribe.
+func (h *Handlers) HandleReportLink(e *core.RequestEvent, action string) error {
+	e.Response.Header().Set("Cache-Control", "no-store")
+	e.Response.Header().Set("X-Robots-Tag", "noindex")
+
+	data := ReportLinkData{Action: action}
+	query := e.Request.URL.Query()
+	subscription, err := h.app.FindRecordById("report_subscriptions", query.Get("id"))
+	if err != nil || subscription.GetString("secret") == "" ||
+		!hmac.Equal([]byte(query.Get("sig")), []byte(reportLinkSignature(subscription, action))) {
+		data.Error = "This link is invalid, or the subscription no longer exists."
+		return h.renderTemplate(e, "report_link.html", data)
+	}
+
+	data.Email = subscription.GetString("email")
+	data.Frequency = subscription.GetString("frequency")
+	if site, err := h.app.FindRecordById("sites", subscription.GetString("site")); err == nil {
+		data.SiteName = site.GetString("name")
+	}
+
+	if e.Request.Method != http.MethodPost {
+		data.Done = action == ReportLinkConfirm && subscription.GetBool("confirmed")
+		return h.renderTemplate(e, "report_link.html", data)
+	}
+
+	if action == ReportLinkConfirm {
+		subscription.Set("confirmed", true)
+		err = h.app.Save(subscription)
+	} else {
+		err = h.app.Delete(subscription)
+	}
+	if err != nil {
+		reportsLog.ErrorContext(e.Request.Context(), "Failed to update subscription", "action", action, "subscription", subscription.Id, "error", err)
+		data.Error = "Something went wrong, please try again later."
+		return h.renderTemplate(e, "report_link.html", data)
+	}
+
+	data.Done = true
+	return h.renderTemplate(e, "report_link.html", data)
+}
+
+// parseUserReportRequest decodes a per-user subscription request. Per-user
+// reports always go to the signed-in account's address.
+func parseUserReportRequest(e *core.RequestEvent) (ReportSubscriptionRequest, error) {
+	var req ReportSubscriptionRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return req, badRequest("Invalid JSON body")
+	}
+
+	if !slices.Contains(ReportFrequencies, req.Frequency) {
+		return req, badRequest("frequency must be one of: " + strings.Join(ReportFrequencies, ", "))
+	}
+	if req.Email != "" && !strings.EqualFold(req.Email, e.Auth.Email()) {
+		return req, badRequest("Per-user reports are sent to your own email address")
+	}
+
+	req.Email = strings.ToLower(e.Auth.Email())
+	return req, nil
+}
+
+// HandleListUserReports lists the signed-in account's per-user report subscriptions
+func (h *Handlers) HandleListUserReports(e *core.RequestEvent) error {
+	subscriptions, err := h.app.FindRecordsByFilter("user_report_subscriptions", userReportField(e.Auth)+" = {:auth}", "frequency", 0, 0, dbx.Params{
+		"auth": e.Auth.Id,
+	})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]ReportSubscription, len(subscriptions))
+	for i, subscription := range subscriptions {
+		result[i] = toReportSubscription(subscription)
+		result[i].Email = strings.ToLower(e.Auth.Email())
+		result[i].Confirmed = true
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"results": result,
+	})
+}
+
+// HandleCreateUserReport subscribes the signed-in account to a weekly or
+// monthly report of every site it can view. Subscribing twice returns the
+// existing subscription.
+func (h *Handlers) HandleCreateUserReport(e *core.RequestEvent) error {
+	req, err := parseUserReportRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	field := userReportField(e.Auth)
+	subscription, err := h.app.FindFirstRecordByFilter("user_report_subscriptions", field+" = {:auth} && frequency = {:frequency}", dbx.Params{
+		"auth":      e.Auth.Id,
+		"frequency": req.Frequency,
+	})
+	if err != nil {
+		collection, err := h.app.FindCollectionByNameOrId("user_report_subscriptions")
+		if err != nil {
+			return writeAPIError(e, err)
+		}
+
+		subscription = core.NewRecord(collection)
+		subscription.Set(field, e.Auth.Id)
+		subscription.Set("frequency", req.Frequency)
+		if err := h.app.Save(subscription); err != nil {
+			return writeAPIError(e, err)
+		}
+	}
+
+	result := toReportSubscription(subscription)
+	result.Email = req.Email
+	result.Confirmed = true
+	return e.JSON(http.StatusOK, result)
+}
+
+// HandleDeleteUserReport unsubscribes the signed-in account from a per-user report
+func (h *Handlers) HandleDeleteUserReport(e *core.RequestEvent) error {
+	subscription, err := h.app.FindFirstRecordByFilter("user_report_subscriptions", "id = {:id} && "+userReportField(e.Auth)+" = {:auth}", dbx.Params{
+		"id":   e.Request.PathValue("reportId"),
+		"auth": e.Auth.Id,
+	})
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Subscription not found"})
+	}
+
+	if err := h.app.Delete(subscription); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// HandleTestUserReport sends the signed-in account's per-user report for the
+// last complete period right away
+func (h *Handlers) HandleTestUserReport(e *core.RequestEvent) error {
+	req, err := parseUserReportRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	report, err := BuildUserReport(h.app, e.Auth, req.Frequency, time.Now())
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+	if len(report.Sites) == 0 {
+		return writeAPIError(e, badRequest("You can't view any active sites yet"))
+	}
+
+	if err := h.sendUserReport(report, req.Email); err != nil {
+		reportsLog.WarnContext(e.Request.Context(), "Failed to send test user report", "error", err)
+		return writeAPIError(e, &apiError{status: http.StatusBadGateway, message: "Failed to send email, check the mail settings: " + err.Error()})
+	}
+
+	return e.JSON(http.StatusOK, map[string]string{"sent_to": req.Email})
+}
+
+// toReportSubscription converts a report_subscriptions record for the report endpoints
+func toReportSubscription(subscription *core.Record) ReportSubscription {
+	result := ReportSubscription{
+		ID:        subscription.Id,
+		Email:     subscription.GetString("email"),
+		Frequency: subscription.GetString("frequency"),
+		Confirmed: subscription.GetBool("confirmed"),
+		Created:   subscription.GetDateTime("created").Time().Format(time.RFC3339),
+	}
+	if lastSent := subscription.GetDateTime("last_sent"); !lastSent.IsZero() {
+		result.LastSent = lastSent.Time().Format(time.RFC3339)
+	}
+	return result
+}
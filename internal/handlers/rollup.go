@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// hourFormat is the strftime format of pageview_hourly.hour, dbTimeLayout cut to the hour
+const hourFormat = "%Y-%m-%d %H:00:00.000Z"
+
+// PageviewTotal is a site's non-spam pageview count, overall and since a given time
+type PageviewTotal struct {
+	Site  string `db:"site"`
+	Total int    `db:"total"`
+	Since int    `db:"since"`
+}
+
+// rollupWatermark returns the start of the first hour that pageview_hourly
+// doesn't count. Every rolled up hour with pageviews has a counter row, so
+// this is the hour after the newest row; zero if nothing was rolled up yet.
+func rollupWatermark(app core.App) (time.Time, error) {
+	var newest struct {
+		Hour string `db:"hour"`
+	}
+	err := app.DB().
+		NewQuery("SELECT COALESCE(MAX(hour), '') as hour FROM pageview_hourly").
+		One(&newest)
+	if err != nil || newest.Hour == "" {
+		return time.Time{}, err
+	}
+
+	hour, err := time.Parse(dbTimeLayout, newest.Hour)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return hour.Add(time.Hour), nil
+}
+
+// RollupHourly counts the pageviews of every completed hour since the last
+// rollup into pageview_hourly
+func RollupHourly(app core.App) error {
+	from, err := rollupWatermark(app)
+	if err != nil {
+		return err
+	}
+
+	to := time.Now().UTC().Truncate(time.Hour)
+	if !from.Before(to) {
+		return nil
+	}
+	return rebuildHourly(app, "", from, to)
+}
+
+// RebuildHourly recounts the hourly counters of a site (or all sites if
+// siteId is empty) between from and to, after its pageviews were deleted or
+// imported with past timestamps. A zero from or to leaves that side open.
+// Hours that aren't rolled up yet are skipped, as they're counted from
+// pageviews directly.
+func RebuildHourly(app core.App, siteId string, from, to time.Time) error {
+	watermark, err := rollupWatermark(app)
+	if err != nil || watermark.IsZero() {
+		return err
+	}
+
+	if to.IsZero() || to.After(watermark) {
+		to = watermark
+	}
+	return rebuildHourly(app, siteId, from.UTC().Truncate(time.Hour), to)
+}
+
+// rebuildHourly replaces the counter rows of the hours in [from, to) with
+// counts of the pageviews they hold. from and to must be on the hour.
+func rebuildHourly(app core.App, siteId string, from, to time.Time) error {
+	hourWhere := "hour < {:to}"
+	createdWhere := "created < {:to}"
+	params := dbx.Params{
+		"to":  to.UTC().Format(dbTimeLayout),
+		"now": time.Now().UTC().Format(dbTimeLayout),
+	}
+	if !from.IsZero() {
+		hourWhere += " AND hour >= {:from}"
+		createdWhere += " AND created >= {:from}"
+		params["from"] = from.UTC().Format(dbTimeLayout)
+	}
+	if siteId != "" {
+		hourWhere += " AND site = {:siteId}"
+		createdWhere += " AND site = {:siteId}"
+		params["siteId"] = siteId
+	}
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		_, err := txApp.DB().
+			NewQuery("DELETE FROM pageview_hourly WHERE " + hourWhere).
+			Bind(params).
+			Execute()
+		if err != nil {
+			return err
+		}
+
+		_, err = txApp.DB().
+			NewQuery("INSERT INTO pageview_hourly (site, hour, pageviews, created, updated) " +
+				"SELECT site, strftime('" + hourFormat + "', created) as hour, COUNT(*), {:now}, {:now} FROM pageviews " +
+				"WHERE spam = FALSE AND " + createdWhere + " GROUP BY site, hour").
+			Bind(params).
+			Execute()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rollups run after pageviews were added or removed, so cached results may be stale
+	InvalidateStatsCache(app, siteId)
+	return nil
+}
+
+// QueryPageviewTotals returns the pageview counts of a site (or every site if
+// siteId is empty), all time and since the given hour, keyed by site ID.
+// They're summed from the hourly counters plus the pageviews newer than the
+// last rollup, so the cost doesn't grow with a site's history.
+func QueryPageviewTotals(app *pocketbase.PocketBase, siteId string, since time.Time) (map[string]PageviewTotal, error) {
+	return cachedQuery("totals", siteId, time.Time{}, formatCacheTime(since), func() (map[string]PageviewTotal, error) {
+		return queryPageviewTotals(app, siteId, since)
+	})
+}
+
+func queryPageviewTotals(app *pocketbase.PocketBase, siteId string, since time.Time) (map[string]PageviewTotal, error) {
+	watermark, err := rollupWatermark(app)
+	if err != nil {
+		return nil, err
+	}
+
+	params := dbx.Params{
+		"since":     since.UTC().Format(dbTimeLayout),
+		"watermark": watermark.UTC().Format(dbTimeLayout),
+	}
+	siteWhere := ""
+	if siteId != "" {
+		siteWhere = " AND site = {:siteId}"
+		params["siteId"] = siteId
+	}
+
+	var rows []PageviewTotal
+	err = app.DB().
+		NewQuery("SELECT site, SUM(total) as total, SUM(since) as since FROM (" +
+			"SELECT site, SUM(pageviews) as total, SUM(CASE WHEN hour >= {:since} THEN pageviews ELSE 0 END) as since FROM pageview_hourly WHERE 1=1" + siteWhere + " GROUP BY site" +
+			" UNION ALL " +
+			"SELECT site, COUNT(*), SUM(CASE WHEN created >= {:since} THEN 1 ELSE 0 END) FROM pageviews WHERE spam = FALSE AND created >= {:watermark}" + siteWhere + " GROUP BY site" +
+			") GROUP BY site").
+		Bind(params).
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]PageviewTotal, len(rows))
+	for _, r := range rows {
+		totals[r.Site] = r
+	}
+	return totals, nil
+}
+
+// QueryDailyPageviews returns the daily pageviews of q.SiteID between q.From
+// and q.To, with imported stats and empty days filled with zeros. It reads the
+// hourly counters, so unlike QueryTimeseries it has no visitors and ignores
+// q.Filters.
+func QueryDailyPageviews(app *pocketbase.PocketBase, q StatsQuery) ([]TimeseriesPoint, error) {
+	q.Filters = nil
+	return cachedQuery("daily", q.SiteID, q.To, q.cacheKey(), func() ([]TimeseriesPoint, error) {
+		return queryDailyPageviews(app, q)
+	})
+}
+
+func queryDailyPageviews(app *pocketbase.PocketBase, q StatsQuery) ([]TimeseriesPoint, error) {
+	watermark, err := rollupWatermark(app)
+	if err != nil {
+		return nil, err
+	}
+
+	tailFrom := q.From
+	if watermark.After(tailFrom) {
+		tailFrom = watermark
+	}
+
+	var rows []TimeseriesPoint
+	err = app.DB().
+		NewQuery("SELECT date, SUM(pageviews) as pageviews FROM (" +
+			"SELECT substr(hour, 1, 10) as date, pageviews FROM pageview_hourly WHERE site = {:siteId} AND hour >= {:from} AND hour < {:to}" +
+			" UNION ALL " +
+			"SELECT strftime('%Y-%m-%d', created), COUNT(*) FROM pageviews WHERE site = {:siteId} AND spam = FALSE AND created >= {:tailFrom} AND created < {:to} GROUP BY 1" +
+			") GROUP BY date ORDER BY date ASC").
+		Bind(dbx.Params{
+			"siteId":   q.SiteID,
+			"from":     q.From.UTC().Format(dbTimeLayout),
+			"to":       q.To.UTC().Format(dbTimeLayout),
+			"tailFrom": tailFrom.UTC().Format(dbTimeLayout),
+		}).
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows, err = mergeImportedDays(app, q, rows); err != nil {
+		return nil, err
+	}
+
+	return fillTimeseries(rows, q.From, q.To, 24*time.Hour, "2006-01-02"), nil
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareSlugLength is long enough that share links can't be guessed
+const shareSlugLength = 32
+
+// shareCookiePrefix names the per-link cookie set after entering a share password
+const shareCookiePrefix = "dd_share_"
+
+var errShareLinkExpired = errors.New("share link has expired")
+
+// SharePasswordData is passed to share_password.html
+type SharePasswordData struct {
+	Slug  string
+	Error string
+}
+
+// ShareLink is a share link as returned by the share management endpoints
+type ShareLink struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Slug        string `json:"slug"`
+	URL         string `json:"url"`
+	HasPassword bool   `json:"has_password"`
+	Expires     string `json:"expires"`
+	Created     string `json:"created"`
+}
+
+// CreateShareLinkRequest is the body of the share link creation endpoint
+type CreateShareLinkRequest struct {
+	Label    string `json:"label"`
+	Password string `json:"password"`
+	Expires  string `json:"expires"` // optional YYYY-MM-DD, the link stops working at the start of that day (UTC)
+}
+
+// findShareLink returns the unexpired share link for slug
+func (h *Handlers) findShareLink(slug string) (*core.Record, error) {
+	link, err := h.app.FindFirstRecordByFilter("share_links", "slug = {:slug}", dbx.Params{"slug": slug})
+	if err != nil {
+		return nil, err
+	}
+
+	expires := link.GetDateTime("expires")
+	if !expires.IsZero() && expires.Time().Before(time.Now()) {
+		return nil, errShareLinkExpired
+	}
+
+	return link, nil
+}
+
+// shareCookieValue derives the cookie proving the password was entered. It's
+// keyed on the password hash, so changing or removing the password invalidates it.
+func shareCookieValue(link *core.Record) string {
+	mac := hmac.New(sha256.New, []byte(link.GetString("password_hash")))
+	mac.Write([]byte(link.GetString("slug")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hasShareAccess reports whether the request may view a share link
+func hasShareAccess(e *core.RequestEvent, link *core.Record) bool {
+	if link.GetString("password_hash") == "" {
+		return true
+	}
+
+	cookie, err := e.Request.Cookie(shareCookiePrefix + link.GetString("slug"))
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie.Value), []byte(shareCookieValue(link)))
+}
+
+// HandleSharedStats renders the read-only stats page of a share link, or its
+// password form. Recent pageviews, user agents and the live view are never shown.
+func (h *Handlers) HandleSharedStats(e *core.RequestEvent) error {
+	slug := e.Request.PathValue("slug")
+
+	link, err := h.findShareLink(slug)
+	if err != nil {
+		return e.JSON(http.StatusNotFound, map[string]string{
+			"error": "Share link not found or expired",
+		})
+	}
+
+	if !hasShareAccess(e, link) {
+		return h.renderTemplate(e, "share_password.html", SharePasswordData{Slug: slug})
+	}
+
+	site, err := h.app.FindRecordById("sites", link.GetString("site"))
+	if err != nil {
+		return e.JSON(http.StatusNotFound, map[string]string{
+			"error": "Share link not found or expired",
+		})
+	}
+
+	// Anyone with the link can load it, so it can't be filtered: every new
+	// filter, e.g. a regular expression, is a full scan of the site's history
+	data := h.siteStatsData(site, nil)
+	data.Shared = true
+
+	e.Response.Header().Set("Cache-Control", "no-store")
+	e.Response.Header().Set("X-Robots-Tag", "noindex")
+	return h.renderTemplate(e, "site_stats.html", data)
+}
+
+// HandleSharePassword checks a share link password and remembers it in a cookie
+func (h *Handlers) HandleSharePassword(e *core.RequestEvent) error {
+	slug := e.Request.PathValue("slug")
+
+	link, err := h.findShareLink(slug)
+	if err != nil {
+		return e.JSON(http.StatusNotFound, map[string]string{
+			"error": "Share link not found or expired",
+		})
+	}
+
+	hash := link.GetString("password_hash")
+	if hash != "" {
+		password := e.Request.FormValue("password")
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return h.renderTemplate(e, "share_password.html", SharePasswordData{Slug: slug, Error: "Incorrect password"})
+		}
+
+		e.SetCookie(&http.Cookie{
+			Name:     shareCookiePrefix + slug,
+			Value:    shareCookieValue(link),
+			Path:     "/share/" + slug,
+			HttpOnly: true,
+			Secure:   e.IsTLS(),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return e.Redirect(http.StatusSeeOther, "/share/"+slug)
+}
+
+// HandleListShareLinks lists a site's share links. Editors and owners may manage them.
+func (h *Handlers) HandleListShareLinks(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage share links"})
+	}
+
+	links, err := h.app.FindRecordsByFilter("share_links", "site = {:site}", "-created", 0, 0, dbx.Params{"site": siteId})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	publicURL := GetPublicURL(e)
+	result := make([]ShareLink, len(links))
+	for i, link := range links {
+		result[i] = toShareLink(link, publicURL)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleCreateShareLink creates a share link for a site
+func (h *Handlers) HandleCreateShareLink(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage share links"})
+	}
+
+	var req CreateShareLinkRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return writeAPIError(e, badRequest("Invalid JSON body"))
+	}
+
+	collection, err := h.app.FindCollectionByNameOrId("share_links")
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	link := core.NewRecord(collection)
+	link.Set("site", siteId)
+	link.Set("label", req.Label)
+	link.Set("slug", security.RandomString(shareSlugLength))
+
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return writeAPIError(e, err)
+		}
+		link.Set("password_hash", string(hash))
+	}
+
+	if req.Expires != "" {
+		expires, err := time.Parse(apiDateLayout, req.Expires)
+		if err != nil {
+			return writeAPIError(e, badRequest("expires must be a YYYY-MM-DD date"))
+		}
+		link.Set("expires", expires)
+	}
+
+	if err := h.app.Save(link); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, toShareLink(link, GetPublicURL(e)))
+}
+
+// HandleDeleteShareLink revokes a share link
+func (h *Handlers) HandleDeleteShareLink(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage share links"})
+	}
+
+	link, err := h.app.FindFirstRecordByFilter("share_links", "id = {:id} && site = {:site}", dbx.Params{
+		"id":   e.Request.PathValue("shareId"),
+		"site": siteId,
+	})
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Share link not found"})
+	}
+
+	if err := h.app.Delete(link); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// toShareLink converts a share_links record for the management endpoints
+func toShareLink(link *core.Record, publicURL string) ShareLink {
+	result := ShareLink{
+		ID:          link.Id,
+		Label:       link.GetString("label"),
+		Slug:        link.GetString("slug"),
+		URL:         publicURL + "/share/" + link.GetString("slug"),
+		HasPassword: link.GetString("password_hash") != "",
+		Created:     link.GetDateTime("created").Time().Format(time.RFC3339),
+	}
+	if expires := link.GetDateTime("expires"); !expires.IsZero() {
+		result.Expires = expires.Time().Format(apiDateLayout)
+	}
+	return result
+}
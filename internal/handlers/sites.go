@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"net/netip"
 	"strings"
 
 	"github.com/pocketbase/pocketbase"
@@ -58,3 +59,61 @@ func ExtractDomain(host string) string {
 	}
 	return host
 }
+
+// IsExcludedIP reports whether the client IP matches one of the site's excluded addresses.
+// The excluded field is a comma-separated list of IP addresses and/or CIDR ranges.
+func IsExcludedIP(ip string, excluded string) bool {
+	if excluded == "" {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, entry := range strings.Split(excluded, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err == nil && prefix.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		excludedAddr, err := netip.ParseAddr(entry)
+		if err == nil && excludedAddr.Unmap() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Goal is a conversion goal of a site, reached when a visitor views Path.
+// A Path ending in * matches every path with that prefix.
+type Goal struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Matches reports whether a pageview of path reaches the goal
+func (g Goal) Matches(path string) bool {
+	if prefix, ok := strings.CutSuffix(g.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == g.Path
+}
+
+// SiteGoals returns the goals configured for a site
+func SiteGoals(site *core.Record) []Goal {
+	var goals []Goal
+	site.UnmarshalJSONField("goals", &goals)
+	return goals
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"embed"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+var spamLog = logging.Component("spam")
+
+//go:embed static/referrer_spam.txt
+var referrerSpamFS embed.FS
+
+var (
+	referrerSpamDomains     map[string]struct{}
+	referrerSpamDomainsOnce sync.Once
+)
+
+// loadReferrerSpamDomains loads the embedded referrer spam domain list
+func loadReferrerSpamDomains() map[string]struct{} {
+	referrerSpamDomainsOnce.Do(func() {
+		referrerSpamDomains = map[string]struct{}{}
+
+		content, err := referrerSpamFS.ReadFile("static/referrer_spam.txt")
+		if err != nil {
+			spamLog.Error("Failed to load referrer spam list", "error", err)
+			return
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.ToLower(strings.TrimSpace(line))
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			referrerSpamDomains[line] = struct{}{}
+		}
+	})
+	return referrerSpamDomains
+}
+
+// IsReferrerSpam reports whether the referrer matches the embedded spam list
+// or one of the site's custom block patterns.
+// The blocklist is a comma-separated list of domains (matching subdomains too)
+// or glob patterns such as "*.example.com".
+func IsReferrerSpam(referrer, blocklist string) bool {
+	host := referrerHost(referrer)
+	if host == "" {
+		return false
+	}
+
+	// Check the host and each parent domain against the embedded list
+	spamDomains := loadReferrerSpamDomains()
+	for d := host; d != ""; d = parentDomain(d) {
+		if _, ok := spamDomains[d]; ok {
+			return true
+		}
+	}
+
+	for _, pattern := range strings.Split(blocklist, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(pattern, "*") {
+			if matched, _ := path.Match(pattern, host); matched {
+				return true
+			}
+			continue
+		}
+		if host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// referrerHost extracts the lowercase host of a referrer URL without port or "www."
+func referrerHost(referrer string) string {
+	referrer = strings.TrimSpace(referrer)
+	if referrer == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(referrer)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+
+	host := strings.ToLower(ExtractDomain(parsed.Host))
+	return strings.TrimPrefix(host, "www.")
+}
+
+// parentDomain strips the left-most label from a domain ("a.b.com" -> "b.com")
+func parentDomain(domain string) string {
+	idx := strings.Index(domain, ".")
+	if idx == -1 {
+		return ""
+	}
+	parent := domain[idx+1:]
+	if !strings.Contains(parent, ".") {
+		return "" // Don't match bare TLDs
+	}
+	return parent
+}
+
+// PurgeReferrerSpam deletes historical pageviews whose referrer matches the
+// spam list or the site's block patterns, along with rows flagged as spam at
+// ingest. If siteId is empty all sites are purged. With dryRun set, matching
+// rows are only counted. It returns the number of matching pageviews.
+func PurgeReferrerSpam(app *pocketbase.PocketBase, siteId string, dryRun bool) (int, error) {
+	filter := "1=1"
+	params := map[string]any{}
+	if siteId != "" {
+		filter = "id = {:siteId}"
+		params["siteId"] = siteId
+	}
+
+	sites, err := app.FindRecordsByFilter("sites", filter, "", 0, 0, params)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, site := range sites {
+		var referrers []struct {
+			Referrer string `db:"referrer"`
+			Views    int    `db:"views"`
+		}
+		err := app.DB().
+			NewQuery("SELECT referrer, COUNT(*) as views FROM pageviews WHERE site = {:siteId} AND referrer != '' AND spam = FALSE GROUP BY referrer").
+			Bind(map[string]any{"siteId": site.Id}).
+			All(&referrers)
+		if err != nil {
+			return total, err
+		}
+
+		blocklist := site.GetString("referrer_blocklist")
+		purged := false
+		for _, r := range referrers {
+			if !IsReferrerSpam(r.Referrer, blocklist) {
+				continue
+			}
+			total += r.Views
+			if dryRun {
+				continue
+			}
+			_, err := app.DB().
+				NewQuery("DELETE FROM pageviews WHERE site = {:siteId} AND referrer = {:referrer}").
+				Bind(map[string]any{"siteId": site.Id, "referrer": r.Referrer}).
+				Execute()
+			if err != nil {
+				return total, err
+			}
+			purged = true
+		}
+
+		// Flagged rows were never counted, but the deleted unflagged ones were
+		if purged {
+			if err := RebuildHourly(app, site.Id, time.Time{}, time.Time{}); err != nil {
+				return total, err
+			}
+		}
+
+		var flagged struct {
+			Count int `db:"count"`
+		}
+		err = app.DB().
+			NewQuery("SELECT COUNT(*) as count FROM pageviews WHERE site = {:siteId} AND spam = TRUE").
+			Bind(map[string]any{"siteId": site.Id}).
+			One(&flagged)
+		if err != nil {
+			return total, err
+		}
+		total += flagged.Count
+		if dryRun || flagged.Count == 0 {
+			continue
+		}
+		_, err = app.DB().
+			NewQuery("DELETE FROM pageviews WHERE site = {:siteId} AND spam = TRUE").
+			Bind(map[string]any{"siteId": site.Id}).
+			Execute()
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
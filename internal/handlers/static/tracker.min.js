@@ -1 +1 @@
-(function(){"use strict";var a=document.getElementsByTagName("script"),o=a[a.length-1],t=o.getAttribute("data-endpoint")||"{{ENDPOINT}}";t=t.replace(/\/$/,"");function r(){return{path:window.location.pathname+window.location.search,referrer:document.referrer||"",screen_width:window.screen.width,screen_height:window.screen.height}}function e(){var d=r();fetch(t+"/api/ping",{method:"POST",headers:{"Content-Type":"application/json"},body:JSON.stringify(d),mode:"cors",credentials:"omit",keepalive:!0}).catch(function(){})}document.readyState==="complete"?e():window.addEventListener("load",e);var i=window.location.pathname;function n(){window.location.pathname!==i&&(i=window.location.pathname,e())}window.addEventListener("popstate",n);var c=history.pushState,s=history.replaceState;history.pushState=function(){c.apply(this,arguments),n()},history.replaceState=function(){s.apply(this,arguments),n()}})();
+(function(){"use strict";var i=document.getElementsByTagName("script"),c=i[i.length-1],e=c.getAttribute("data-endpoint")||"{{ENDPOINT}}";e=e.replace(/\/$/,"");var n="dingdong_ignore";function s(){var t=/[?&]dingdong_ignore=(true|false)/.exec(window.location.search);if(t)try{t[1]==="true"?localStorage.setItem(n,"true"):localStorage.removeItem(n)}catch{}}function d(){try{return localStorage.getItem(n)==="true"}catch{return!1}}s();function l(){return{path:window.location.pathname+window.location.search,referrer:document.referrer||"",screen_width:window.screen.width,screen_height:window.screen.height,gpc:navigator.globalPrivacyControl===!0}}function a(){if(!d()){var t=l();fetch(e+"/api/ping",{method:"POST",headers:{"Content-Type":"application/json"},body:JSON.stringify(t),mode:"cors",credentials:"omit",keepalive:!0}).catch(function(){})}}document.readyState==="complete"?a():window.addEventListener("load",a);var o=window.location.pathname;function r(){window.location.pathname!==o&&(o=window.location.pathname,a())}window.addEventListener("popstate",r);var u=history.pushState,h=history.replaceState;history.pushState=function(){u.apply(this,arguments),r()},history.replaceState=function(){h.apply(this,arguments),r()}})();
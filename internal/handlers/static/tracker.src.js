@@ -10,18 +10,49 @@
   // Remove trailing slash if present
   endpoint = endpoint.replace(/\/$/, '');
   
+  // Opt-out flag so site owners can exclude their own visits.
+  // Visit any page with ?dingdong_ignore=true to opt out, or =false to opt back in.
+  var ignoreKey = 'dingdong_ignore';
+  
+  function updateOptOut() {
+    var match = /[?&]dingdong_ignore=(true|false)/.exec(window.location.search);
+    if (!match) return;
+    try {
+      if (match[1] === 'true') {
+        localStorage.setItem(ignoreKey, 'true');
+      } else {
+        localStorage.removeItem(ignoreKey);
+      }
+    } catch (e) {
+      // localStorage unavailable (e.g. privacy mode)
+    }
+  }
+  
+  function isIgnored() {
+    try {
+      return localStorage.getItem(ignoreKey) === 'true';
+    } catch (e) {
+      return false;
+    }
+  }
+  
+  updateOptOut();
+  
   // Collect page data
   function collectData() {
     return {
       path: window.location.pathname + window.location.search,
       referrer: document.referrer || '',
       screen_width: window.screen.width,
-      screen_height: window.screen.height
+      screen_height: window.screen.height,
+      gpc: navigator.globalPrivacyControl === true
     };
   }
   
   // Send ping to server
   function sendPing() {
+    if (isIgnored()) return;
+    
     var data = collectData();
     
     // Use fetch with no credentials to avoid CORS issues
@@ -0,0 +1,25 @@
+// DingDong embeddable stats widget
+// Usage: <script src="https://stats.example.com/widget.js" data-site="SITE_ID" data-metric="views" data-range="30d" async></script>
+(function() {
+    'use strict';
+
+    var script = document.currentScript;
+    if (!script || !script.dataset.site) {
+        console.error('[DingDong] widget.js needs a data-site attribute');
+        return;
+    }
+
+    var params = new URLSearchParams();
+    if (script.dataset.metric) params.set('metric', script.dataset.metric);
+    if (script.dataset.range) params.set('range', script.dataset.range);
+
+    var iframe = document.createElement('iframe');
+    iframe.src = '{{ENDPOINT}}/widget/' + encodeURIComponent(script.dataset.site) + '?' + params.toString();
+    iframe.title = 'Site stats';
+    iframe.width = script.dataset.width || '200';
+    iframe.height = script.dataset.height || '90';
+    iframe.style.border = '0';
+    iframe.loading = 'lazy';
+
+    script.parentNode.insertBefore(iframe, script.nextSibling);
+})();
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// dbTimeLayout matches how PocketBase stores datetimes, so they compare as strings
+const dbTimeLayout = "2006-01-02 15:04:05.000Z"
+
+// breakdownColumns maps the public breakdown/filter property names to pageviews columns
+var breakdownColumns = map[string]string{
+	"path":     "path",
+	"referrer": "referrer",
+	"browser":  "browser",
+	"os":       "os",
+	"device":   "device",
+	"country":  "country",
+
+	// The referrer's host without "www.", e.g. news.ycombinator.com
+	"referrer_source": "referrer_source",
+
+	"utm_source":   "utm_source",
+	"utm_medium":   "utm_medium",
+	"utm_campaign": "utm_campaign",
+}
+
+// importedOnlyProperties are breakdown properties that only imported stats
+// have, like the traffic source names ("Google") of Plausible and GA4.
+// Tracked pageviews have no such column, so they can't be filtered by.
+var importedOnlyProperties = []string{"source"}
+
+// BreakdownProperties returns the supported breakdown/filter property names
+func BreakdownProperties() []string {
+	props := make([]string, 0, len(breakdownColumns))
+	for p := range breakdownColumns {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+	return props
+}
+
+// StatsQuery selects the pageviews of a site within a time range that match
+// all of its filters. A zero From or To leaves that side of the range open.
+type StatsQuery struct {
+	SiteID  string
+	From    time.Time
+	To      time.Time
+	Filters []Filter
+}
+
+// Aggregate holds the headline numbers of a stats query
+type Aggregate struct {
+	Pageviews int `db:"pageviews" json:"pageviews"`
+	Visitors  int `db:"visitors" json:"visitors"`
+}
+
+// TimeseriesPoint is the pageview count of a single time bucket
+type TimeseriesPoint struct {
+	Date      string `db:"date" json:"date"`
+	Pageviews int    `db:"pageviews" json:"pageviews"`
+	Visitors  int    `db:"visitors" json:"visitors"`
+	Imported  bool   `db:"-" json:"imported,omitempty"` // includes imported_stats counts
+}
+
+// BreakdownItem is the pageview count of a single property value
+type BreakdownItem struct {
+	Value     string `db:"value" json:"value"`
+	Pageviews int    `db:"pageviews" json:"pageviews"`
+	Visitors  int    `db:"visitors" json:"visitors"`
+}
+
+// where builds the SQL condition and params shared by every stats query
+func (q StatsQuery) where() (string, dbx.Params) {
+	conditions := []string{"site = {:siteId}", "spam = FALSE"}
+	params := dbx.Params{"siteId": q.SiteID}
+
+	if !q.From.IsZero() {
+		conditions = append(conditions, "created >= {:from}")
+		params["from"] = q.From.UTC().Format(dbTimeLayout)
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "created < {:to}")
+		params["to"] = q.To.UTC().Format(dbTimeLayout)
+	}
+
+	for i, f := range q.Filters {
+		conditions = append(conditions, f.condition(fmt.Sprintf("filter%d", i), params))
+	}
+
+	return strings.Join(conditions, " AND "), params
+}
+
+// importedWhere builds the condition selecting the imported_stats rows of a
+// dimension ("" for the daily totals). Imported rollups only count single
+// properties per day, so filtered queries never include them.
+func (q StatsQuery) importedWhere(dimension string) (string, dbx.Params, bool) {
+	if len(q.Filters) > 0 {
+		return "", nil, false
+	}
+
+	conditions := []string{"site = {:importSite}", "dimension = {:importDimension}"}
+	params := dbx.Params{"importSite": q.SiteID, "importDimension": dimension}
+
+	if !q.From.IsZero() {
+		conditions = append(conditions, "day >= {:importFrom}")
+		params["importFrom"] = q.From.UTC().Format(ImportDayLayout)
+	}
+	if !q.To.IsZero() {
+		// To is exclusive, so a range ending at midnight stops the day before
+		conditions = append(conditions, "day <= {:importTo}")
+		params["importTo"] = q.To.UTC().Add(-time.Nanosecond).Format(ImportDayLayout)
+	}
+
+	return strings.Join(conditions, " AND "), params, true
+}
+
+// QueryAggregate returns total pageviews and unique visitors for the query
+func QueryAggregate(app *pocketbase.PocketBase, q StatsQuery) (Aggregate, error) {
+	return cachedQuery("aggregate", q.SiteID, q.To, q.cacheKey(), func() (Aggregate, error) {
+		return queryAggregate(app, q)
+	})
+}
+
+func queryAggregate(app *pocketbase.PocketBase, q StatsQuery) (Aggregate, error) {
+	where, params := q.where()
+
+	var result Aggregate
+	err := app.DB().
+		NewQuery("SELECT COUNT(*) as pageviews, COUNT(DISTINCT NULLIF(ip_hash, '')) as visitors FROM pageviews WHERE " + where).
+		Bind(params).
+		One(&result)
+	if err != nil {
+		return result, err
+	}
+
+	if where, params, ok := q.importedWhere(""); ok {
+		var imported Aggregate
+		err = app.DB().
+			NewQuery("SELECT COALESCE(SUM(pageviews), 0) as pageviews, COALESCE(SUM(visitors), 0) as visitors FROM imported_stats WHERE " + where).
+			Bind(params).
+			One(&imported)
+		result.Pageviews += imported.Pageviews
+		result.Visitors += imported.Visitors
+	}
+
+	return result, err
+}
+
+// QueryTimeseries returns pageviews grouped by "day" or "hour" buckets in ascending order.
+// When the query has both a From and To, empty buckets are filled with zeros.
+// Daily buckets include imported stats; hourly ones can't, as imports are per day.
+func QueryTimeseries(app *pocketbase.PocketBase, q StatsQuery, interval string) ([]TimeseriesPoint, error) {
+	return cachedQuery("timeseries", q.SiteID, q.To, q.cacheKey()+"|"+interval, func() ([]TimeseriesPoint, error) {
+		return queryTimeseries(app, q, interval)
+	})
+}
+
+func queryTimeseries(app *pocketbase.PocketBase, q StatsQuery, interval string) ([]TimeseriesPoint, error) {
+	bucketFormat, step, layout := "%Y-%m-%d", 24*time.Hour, "2006-01-02"
+	if interval == "hour" {
+		bucketFormat, step, layout = "%Y-%m-%d %H:00", time.Hour, "2006-01-02 15:04"
+	}
+
+	where, params := q.where()
+
+	var rows []TimeseriesPoint
+	err := app.DB().
+		NewQuery("SELECT strftime('" + bucketFormat + "', created) as date, COUNT(*) as pageviews, COUNT(DISTINCT NULLIF(ip_hash, '')) as visitors FROM pageviews WHERE " + where + " GROUP BY date ORDER BY date ASC").
+		Bind(params).
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval == "day" {
+		if rows, err = mergeImportedDays(app, q, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.From.IsZero() || q.To.IsZero() {
+		return rows, nil
+	}
+
+	return fillTimeseries(rows, q.From, q.To, step, layout), nil
+}
+
+// fillTimeseries returns a point for every step between from and to, taking
+// the counts from rows and zeros for the buckets rows don't have
+func fillTimeseries(rows []TimeseriesPoint, from, to time.Time, step time.Duration, layout string) []TimeseriesPoint {
+	byDate := make(map[string]TimeseriesPoint, len(rows))
+	for _, r := range rows {
+		byDate[r.Date] = r
+	}
+
+	points := []TimeseriesPoint{}
+	for t := from.UTC().Truncate(step); t.Before(to); t = t.Add(step) {
+		date := t.Format(layout)
+		if p, ok := byDate[date]; ok {
+			points = append(points, p)
+		} else {
+			points = append(points, TimeseriesPoint{Date: date})
+		}
+	}
+
+	return points
+}
+
+// mergeImportedDays adds the imported daily totals to the days of rows,
+// keeping them in ascending order
+func mergeImportedDays(app *pocketbase.PocketBase, q StatsQuery, rows []TimeseriesPoint) ([]TimeseriesPoint, error) {
+	where, params, ok := q.importedWhere("")
+	if !ok {
+		return rows, nil
+	}
+
+	var imported []TimeseriesPoint
+	err := app.DB().
+		NewQuery("SELECT day as date, SUM(pageviews) as pageviews, SUM(visitors) as visitors FROM imported_stats WHERE " + where + " GROUP BY day").
+		Bind(params).
+		All(&imported)
+	if err != nil || len(imported) == 0 {
+		return rows, err
+	}
+
+	byDate := make(map[string]int, len(rows))
+	for i, r := range rows {
+		byDate[r.Date] = i
+	}
+	for _, p := range imported {
+		p.Imported = true
+		if i, ok := byDate[p.Date]; ok {
+			rows[i].Pageviews += p.Pageviews
+			rows[i].Visitors += p.Visitors
+			rows[i].Imported = true
+		} else {
+			rows = append(rows, p)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Date < rows[j].Date })
+	return rows, nil
+}
+
+// QueryBreakdown returns pageviews grouped by a property, most viewed first.
+// Empty values (e.g. direct traffic for referrer) are excluded. Imported
+// stats are added to the counts of the matching values.
+func QueryBreakdown(app *pocketbase.PocketBase, q StatsQuery, property string, limit, offset int) ([]BreakdownItem, error) {
+	key := fmt.Sprintf("%s|%s|%d|%d", q.cacheKey(), property, limit, offset)
+	return cachedQuery("breakdown", q.SiteID, q.To, key, func() ([]BreakdownItem, error) {
+		return queryBreakdown(app, q, property, limit, offset)
+	})
+}
+
+func queryBreakdown(app *pocketbase.PocketBase, q StatsQuery, property string, limit, offset int) ([]BreakdownItem, error) {
+	column, ok := breakdownColumns[property]
+	if !ok {
+		if slices.Contains(importedOnlyProperties, property) {
+			return queryImportedBreakdown(app, q, property, limit, offset)
+		}
+		return nil, fmt.Errorf("unsupported breakdown property %q", property)
+	}
+
+	where, params := q.where()
+	params["limit"] = limit
+	params["offset"] = offset
+
+	query := "SELECT " + column + " as value, COUNT(*) as pageviews, COUNT(DISTINCT NULLIF(ip_hash, '')) as visitors FROM pageviews WHERE " + where + " AND " + column + " != '' GROUP BY " + column
+	if importedWhere, importedParams, ok := q.importedWhere(property); ok {
+		query = "SELECT value, SUM(pageviews) as pageviews, SUM(visitors) as visitors FROM (" +
+			query + " UNION ALL SELECT value, SUM(pageviews), SUM(visitors) FROM imported_stats WHERE " + importedWhere + " AND value != '' GROUP BY value" +
+			") GROUP BY value"
+		for k, v := range importedParams {
+			params[k] = v
+		}
+	}
+
+	items := []BreakdownItem{}
+	err := app.DB().
+		NewQuery(query + " ORDER BY pageviews DESC, value ASC LIMIT {:limit} OFFSET {:offset}").
+		Bind(params).
+		All(&items)
+
+	return items, err
+}
+
+// queryImportedBreakdown groups the imported stats of an imported-only
+// property. Filtered queries have none, as imports can't be filtered.
+func queryImportedBreakdown(app *pocketbase.PocketBase, q StatsQuery, property string, limit, offset int) ([]BreakdownItem, error) {
+	items := []BreakdownItem{}
+	where, params, ok := q.importedWhere(property)
+	if !ok {
+		return items, nil
+	}
+	params["limit"] = limit
+	params["offset"] = offset
+
+	err := app.DB().
+		NewQuery("SELECT value, SUM(pageviews) as pageviews, SUM(visitors) as visitors FROM imported_stats WHERE " + where + " AND value != '' GROUP BY value ORDER BY pageviews DESC, value ASC LIMIT {:limit} OFFSET {:offset}").
+		Bind(params).
+		All(&items)
+
+	return items, err
+}
+
+// QueryRecentPageviews returns the newest pageviews matching the query
+func QueryRecentPageviews(app *pocketbase.PocketBase, q StatsQuery, limit int) ([]PageviewRecord, error) {
+	where, params := q.where()
+	params["limit"] = limit
+
+	var rows []struct {
+		Path      string         `db:"path"`
+		Referrer  string         `db:"referrer"`
+		UserAgent string         `db:"user_agent"`
+		Created   types.DateTime `db:"created"`
+	}
+	err := app.DB().
+		NewQuery("SELECT path, referrer, user_agent, created FROM pageviews WHERE " + where + " ORDER BY created DESC LIMIT {:limit}").
+		Bind(params).
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]PageviewRecord, len(rows))
+	for i, r := range rows {
+		views[i] = PageviewRecord{Path: r.Path, Referrer: r.Referrer, CreatedAt: r.Created.Time(), UserAgent: r.UserAgent}
+	}
+	return views, nil
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var tokensLog = logging.Component("tokens")
+
+// API token scopes
+const (
+	ScopeStatsRead   = "stats:read"
+	ScopeEventsWrite = "events:write"
+)
+
+// APITokenScopes lists every scope a token can be granted
+var APITokenScopes = []string{ScopeStatsRead, ScopeEventsWrite}
+
+// APITokenKey is the request store key under which an authenticated
+// api_tokens record is kept for handlers further down the chain
+const APITokenKey = "apiToken"
+
+// apiTokenPrefix marks DingDong tokens so they're easy to spot in configs and secret scanners
+const apiTokenPrefix = "dd_"
+
+// lastUsedResolution limits how often last_used is written for a busy token
+const lastUsedResolution = time.Minute
+
+var (
+	ErrAPITokenInvalid = errors.New("invalid API token")
+	ErrAPITokenExpired = errors.New("API token has expired")
+)
+
+// HashAPIToken returns the hex SHA-256 of a plaintext token, which is all that's stored
+func HashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// FindAPIToken looks up the api_tokens record for a plaintext token,
+// rejecting unknown and expired tokens
+func FindAPIToken(app core.App, token string) (*core.Record, error) {
+	if token == "" {
+		return nil, ErrAPITokenInvalid
+	}
+
+	record, err := app.FindFirstRecordByFilter("api_tokens", "token_hash = {:hash}", dbx.Params{
+		"hash": HashAPIToken(token),
+	})
+	if err != nil {
+		return nil, ErrAPITokenInvalid
+	}
+
+	expires := record.GetDateTime("expires")
+	if !expires.IsZero() && expires.Time().Before(time.Now()) {
+		return nil, ErrAPITokenExpired
+	}
+
+	return record, nil
+}
+
+// TokenHasScope reports whether the token was granted scope
+func TokenHasScope(token *core.Record, scope string) bool {
+	return slices.Contains(token.GetStringSlice("scopes"), scope)
+}
+
+// TokenAllowsSite reports whether the token may access siteId. Only tokens
+// created with all_sites are allowed on every site; a token whose sites were
+// all deleted is allowed on none.
+func TokenAllowsSite(token *core.Record, siteId string) bool {
+	return token.GetBool("all_sites") || slices.Contains(token.GetStringSlice("sites"), siteId)
+}
+
+// TouchAPIToken updates the token's last_used time, at most once per lastUsedResolution
+func TouchAPIToken(app core.App, token *core.Record) {
+	now := time.Now().UTC()
+	if last := token.GetDateTime("last_used"); !last.IsZero() && now.Sub(last.Time()) < lastUsedResolution {
+		return
+	}
+
+	// Plain UPDATE so a token use doesn't bump "updated" or fire record hooks
+	_, err := app.DB().
+		NewQuery("UPDATE api_tokens SET last_used = {:now} WHERE id = {:id}").
+		Bind(dbx.Params{"now": now.Format(dbTimeLayout), "id": token.Id}).
+		Execute()
+	if err != nil {
+		tokensLog.Error("Failed to update last_used", "token", token.Id, "error", err)
+	}
+}
+
+// CreateAPITokenRequest is the body of the token creation endpoint
+type CreateAPITokenRequest struct {
+	Name     string   `json:"name"`
+	AllSites bool     `json:"all_sites"` // access every site, including ones added later
+	Sites    []string `json:"sites"`
+	Scopes   []string `json:"scopes"`
+	Expires  string   `json:"expires"` // optional YYYY-MM-DD, the token stops working at the start of that day (UTC)
+}
+
+// HandleCreateAPIToken creates an api_tokens record and returns the plaintext
+// token. Only the hash is stored, so this is the only time it can be seen.
+func (h *Handlers) HandleCreateAPIToken(e *core.RequestEvent) error {
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return writeAPIError(e, badRequest("Invalid JSON body"))
+	}
+
+	if req.Name == "" {
+		return writeAPIError(e, badRequest("name is required"))
+	}
+	if len(req.Scopes) == 0 {
+		return writeAPIError(e, badRequest("at least one scope is required"))
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(APITokenScopes, scope) {
+			return writeAPIError(e, badRequest("unknown scope: "+scope))
+		}
+	}
+	if req.AllSites && len(req.Sites) > 0 {
+		return writeAPIError(e, badRequest("sites can't be combined with all_sites"))
+	}
+	if !req.AllSites && len(req.Sites) == 0 {
+		return writeAPIError(e, badRequest("at least one site, or all_sites, is required"))
+	}
+	for _, siteId := range req.Sites {
+		if _, err := h.app.FindRecordById("sites", siteId); err != nil {
+			return writeAPIError(e, badRequest("unknown site: "+siteId))
+		}
+	}
+
+	var expires time.Time
+	if req.Expires != "" {
+		parsed, err := time.Parse(apiDateLayout, req.Expires)
+		if err != nil {
+			return writeAPIError(e, badRequest("expires must be a YYYY-MM-DD date"))
+		}
+		expires = parsed
+	}
+
+	token, record, err := CreateAPIToken(h.app, req.Name, e.Auth, req.AllSites, req.Sites, req.Scopes, expires)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"id":    record.Id,
+		"name":  record.GetString("name"),
+		"token": token,
+	})
+}
+
+// CreateAPIToken generates a new token, stores its hash and returns the plaintext.
+// owner may be nil for tokens created outside of a request (e.g. from the CLI).
+// The token may access the given sites, or every site if allSites is set.
+func CreateAPIToken(app *pocketbase.PocketBase, name string, owner *core.Record, allSites bool, sites, scopes []string, expires time.Time) (string, *core.Record, error) {
+	collection, err := app.FindCollectionByNameOrId("api_tokens")
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(secret)
+
+	record := core.NewRecord(collection)
+	record.Set("name", name)
+	record.Set("token_hash", HashAPIToken(token))
+	record.Set("token_prefix", token[:len(apiTokenPrefix)+6])
+	record.Set("all_sites", allSites)
+	record.Set("sites", sites)
+	record.Set("scopes", scopes)
+	if owner != nil && owner.Collection().Name == core.CollectionNameSuperusers {
+		record.Set("owner", owner.Id)
+	}
+	if !expires.IsZero() {
+		record.Set("expires", expires)
+	}
+
+	if err := app.Save(record); err != nil {
+		return "", nil, err
+	}
+
+	tokensLog.Info("Created API token", "token", record.Id, "name", name)
+	return token, record, nil
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"embed"
+	"errors"
 	"os"
 	"strings"
 	"sync"
@@ -14,6 +15,7 @@ var trackerFS embed.FS
 
 var (
 	trackerScript     string
+	trackerScriptErr  error
 	trackerScriptOnce sync.Once
 )
 
@@ -23,6 +25,7 @@ func loadTrackerScript() string {
 		content, err := trackerFS.ReadFile("static/tracker.min.js")
 		if err != nil {
 			trackerScript = "console.error('Failed to load tracker script');"
+			trackerScriptErr = err
 			return
 		}
 		trackerScript = string(content)
@@ -30,6 +33,19 @@ func loadTrackerScript() string {
 	return trackerScript
 }
 
+// CheckTrackerScript returns an error if the tracker script failed to load or
+// can't be pointed at this server
+func CheckTrackerScript() error {
+	script := loadTrackerScript()
+	if trackerScriptErr != nil {
+		return trackerScriptErr
+	}
+	if !strings.Contains(script, "{{ENDPOINT}}") {
+		return errors.New("tracker script has no {{ENDPOINT}} placeholder")
+	}
+	return nil
+}
+
 // GetPublicURL returns the public URL for the application
 func GetPublicURL(e *core.RequestEvent) string {
 	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
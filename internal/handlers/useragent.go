@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"strings"
+)
+
+// UserAgentInfo holds the coarse browser, OS and device class derived from a User-Agent
+type UserAgentInfo struct {
+	Browser string
+	OS      string
+	Device  string
+}
+
+// ParseUserAgent derives browser, OS and device class from a User-Agent string.
+// It only recognizes common families; everything else is reported as "Other".
+func ParseUserAgent(ua string) UserAgentInfo {
+	if ua == "" {
+		return UserAgentInfo{}
+	}
+
+	lower := strings.ToLower(ua)
+	if isBotUserAgent(lower) {
+		return UserAgentInfo{Browser: "Bot", OS: "Other", Device: "bot"}
+	}
+
+	return UserAgentInfo{
+		Browser: parseBrowser(ua),
+		OS:      parseOS(ua),
+		Device:  parseDevice(ua),
+	}
+}
+
+// isBotUserAgent reports whether a lowercased User-Agent looks like a crawler
+func isBotUserAgent(lower string) bool {
+	for _, marker := range []string{"bot", "crawler", "spider", "slurp", "headless", "curl/", "wget/", "python-requests"} {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBrowser returns the browser family. Order matters since most
+// browsers also claim to be Chrome and/or Safari.
+func parseBrowser(ua string) string {
+	switch {
+	case strings.Contains(ua, "Edg/"), strings.Contains(ua, "EdgA/"), strings.Contains(ua, "EdgiOS/"):
+		return "Edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		return "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		return "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		return "Safari"
+	case strings.Contains(ua, "MSIE "), strings.Contains(ua, "Trident/"):
+		return "Internet Explorer"
+	}
+	return "Other"
+}
+
+// parseOS returns the operating system family
+func parseOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return "iOS"
+	case strings.Contains(ua, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		return "macOS"
+	case strings.Contains(ua, "Linux"):
+		return "Linux"
+	}
+	return "Other"
+}
+
+// parseDevice returns "mobile", "tablet" or "desktop"
+func parseDevice(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"):
+		return "tablet"
+	case strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		return "tablet"
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		return "mobile"
+	}
+	return "desktop"
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+)
+
+// maxUTMLength is the length of the pageviews utm_* fields
+const maxUTMLength = 255
+
+// UTM holds the campaign parameters of a page URL
+type UTM struct {
+	Source   string
+	Medium   string
+	Campaign string
+}
+
+// ParseUTM reads utm_source, utm_medium and utm_campaign from the query
+// string of a tracked path such as /pricing?utm_source=newsletter
+func ParseUTM(path string) UTM {
+	_, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return UTM{}
+	}
+	query, _, _ = strings.Cut(query, "#")
+
+	params, _ := url.ParseQuery(query)
+	return UTM{
+		Source:   utmValue(params, "utm_source"),
+		Medium:   utmValue(params, "utm_medium"),
+		Campaign: utmValue(params, "utm_campaign"),
+	}
+}
+
+func utmValue(params url.Values, name string) string {
+	value := strings.TrimSpace(params.Get(name))
+	if len(value) > maxUTMLength {
+		value = strings.ToValidUTF8(value[:maxUTMLength], "")
+	}
+	return value
+}
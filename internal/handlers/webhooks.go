@@ -0,0 +1,751 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+var webhooksLog = logging.Component("webhooks")
+
+// Webhook event types
+const (
+	WebhookEventPageview = "pageview"
+	WebhookEventGoal     = "goal"
+)
+
+// WebhookEvents lists every event a webhook can subscribe to
+var WebhookEvents = []string{WebhookEventPageview, WebhookEventGoal}
+
+const (
+	// webhookQueueSize is how many pageviews can wait for the worker before
+	// HandlePing starts dropping them rather than slowing down
+	webhookQueueSize = 1000
+
+	// webhookPollInterval is how often the worker looks for retries that are due
+	webhookPollInterval = 10 * time.Second
+	// webhookStallAfter is how long a running worker can go without finishing
+	// a loop or an attempt before it counts as stuck
+	webhookStallAfter = 2 * time.Minute
+
+	// webhookMaxAttempts is how many times a delivery is tried before it fails.
+	// With webhookRetryDelay doubling each time, the last retry is about an
+	// hour in: 30s × (2⁷ − 1) = 63.5 minutes.
+	webhookMaxAttempts = 8
+	webhookRetryDelay  = 30 * time.Second
+
+	// webhookBatchSize is how many due deliveries are loaded per poll
+	webhookBatchSize = 100
+	// webhookSendConcurrency is how many deliveries are sent at once, and
+	// webhookSendsPerWebhook how many of those may go to the same webhook, so
+	// a slow receiver only holds up its own deliveries
+	webhookSendConcurrency = 10
+	webhookSendsPerWebhook = 2
+
+	// webhookDeliveryLimit is how many deliveries the log endpoint returns
+	webhookDeliveryLimit = 50
+
+	webhookSecretLength = 32
+)
+
+// WebhookPayload is the JSON body POSTed for an event
+type WebhookPayload struct {
+	Event    string          `json:"event"`
+	SiteID   string          `json:"site_id"`
+	Domain   string          `json:"domain"`
+	Pageview WebhookPageview `json:"pageview"`
+	Goal     *Goal           `json:"goal,omitempty"`
+}
+
+// WebhookPageview is the pageview included in every webhook payload
+type WebhookPageview struct {
+	ID           string `json:"id"`
+	Path         string `json:"path"`
+	Referrer     string `json:"referrer"`
+	Country      string `json:"country"`
+	Browser      string `json:"browser"`
+	OS           string `json:"os"`
+	Device       string `json:"device"`
+	ScreenWidth  int    `json:"screen_width"`
+	ScreenHeight int    `json:"screen_height"`
+	Created      string `json:"created"`
+}
+
+// Webhook is a webhook as returned by the webhook endpoints
+type Webhook struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret"`
+	Events  []string `json:"events"`
+	Active  bool     `json:"active"`
+	Created string   `json:"created"`
+}
+
+// WebhookRequest is the body of the webhook create and update endpoints
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"` // defaults to true
+}
+
+// WebhookDelivery is a delivery log entry as returned by the webhook endpoints
+type WebhookDelivery struct {
+	ID             string `json:"id"`
+	WebhookID      string `json:"webhook_id"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttempt    string `json:"next_attempt"`
+	ResponseStatus int    `json:"response_status"`
+	Error          string `json:"error"`
+	Created        string `json:"created"`
+}
+
+// webhookJob is a pageview waiting for the worker to match it against webhooks
+type webhookJob struct {
+	site     *core.Record
+	pageview WebhookPageview
+}
+
+// WebhookWorker delivers webhooks in the background so ingestion never waits
+// on a receiver. Pageviews are handed over in memory; deliveries are stored
+// in webhook_deliveries before the first attempt, so retries survive restarts.
+// Matching and sending run in separate loops, so the queue keeps draining
+// while receivers are slow.
+type WebhookWorker struct {
+	app   *pocketbase.PocketBase
+	queue chan webhookJob
+	wake  chan struct{}
+
+	running    atomic.Bool
+	lastActive atomic.Int64 // unix nanoseconds
+
+	mu         sync.Mutex
+	inFlight   map[string]bool // ids of the deliveries being sent
+	perWebhook map[string]int  // deliveries being sent to each webhook
+	sends      sync.WaitGroup
+}
+
+// WebhookWorkerStatus describes the worker for health checks and metrics
+type WebhookWorkerStatus struct {
+	Running    bool
+	Stalled    bool
+	QueueDepth int
+	QueueSize  int
+	LastActive time.Time
+}
+
+// NewWebhookWorker creates a worker. It doesn't deliver anything until Run.
+func NewWebhookWorker(app *pocketbase.PocketBase) *WebhookWorker {
+	return &WebhookWorker{
+		app:        app,
+		queue:      make(chan webhookJob, webhookQueueSize),
+		wake:       make(chan struct{}, 1),
+		inFlight:   map[string]bool{},
+		perWebhook: map[string]int{},
+	}
+}
+
+// Enqueue hands a saved pageview to the worker without blocking. If the queue
+// is full the pageview's webhooks are skipped.
+func (w *WebhookWorker) Enqueue(site, pageview *core.Record) {
+	job := webhookJob{
+		site: site,
+		pageview: WebhookPageview{
+			ID:           pageview.Id,
+			Path:         pageview.GetString("path"),
+			Referrer:     pageview.GetString("referrer"),
+			Country:      pageview.GetString("country"),
+			Browser:      pageview.GetString("browser"),
+			OS:           pageview.GetString("os"),
+			Device:       pageview.GetString("device"),
+			ScreenWidth:  pageview.GetInt("screen_width"),
+			ScreenHeight: pageview.GetInt("screen_height"),
+			Created:      pageview.GetDateTime("created").Time().Format(time.RFC3339),
+		},
+	}
+
+	select {
+	case w.queue <- job:
+	default:
+		webhooksLog.Warn("Queue full, skipped webhooks for pageview", "pageview", pageview.Id)
+	}
+}
+
+// Status returns the queue depth and whether the worker is running and keeping up
+func (w *WebhookWorker) Status() WebhookWorkerStatus {
+	status := WebhookWorkerStatus{
+		Running:    w.running.Load(),
+		QueueDepth: len(w.queue),
+		QueueSize:  cap(w.queue),
+	}
+	if last := w.lastActive.Load(); last != 0 {
+		status.LastActive = time.Unix(0, last)
+	}
+	status.Stalled = status.Running && time.Since(status.LastActive) > webhookStallAfter
+	return status
+}
+
+// beat records that the worker is making progress
+func (w *WebhookWorker) beat() {
+	w.lastActive.Store(time.Now().UnixNano())
+}
+
+// Run matches queued pageviews and sends due deliveries until ctx is done
+func (w *WebhookWorker) Run(ctx context.Context) {
+	w.beat()
+	w.running.Store(true)
+	defer w.running.Store(false)
+
+	var sender sync.WaitGroup
+	sender.Go(func() { w.runDeliveries(ctx) })
+	defer w.sends.Wait()
+	defer sender.Wait()
+
+	for {
+		w.beat()
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-w.queue:
+			w.createDeliveries(job)
+			w.Wake()
+		}
+	}
+}
+
+// runDeliveries sends due deliveries when woken and at every poll until ctx is done
+func (w *WebhookWorker) runDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+		w.deliverDue(ctx)
+		w.beat()
+	}
+}
+
+// Wake makes the worker send due deliveries now instead of at the next poll
+func (w *WebhookWorker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// createDeliveries stores a pending delivery for each active webhook of the
+// pageview's site that subscribes to the pageview or a goal it reached
+func (w *WebhookWorker) createDeliveries(job webhookJob) {
+	webhooks, err := w.app.FindRecordsByFilter("webhooks", "site = {:site} && active = true", "", 0, 0, dbx.Params{"site": job.site.Id})
+	if err != nil || len(webhooks) == 0 {
+		return
+	}
+
+	var goals []Goal
+	for _, goal := range SiteGoals(job.site) {
+		if goal.Matches(job.pageview.Path) {
+			goals = append(goals, goal)
+		}
+	}
+
+	for _, webhook := range webhooks {
+		events := webhook.GetStringSlice("events")
+		if slices.Contains(events, WebhookEventPageview) {
+			w.createDelivery(webhook, WebhookPayload{
+				Event:    WebhookEventPageview,
+				SiteID:   job.site.Id,
+				Domain:   job.site.GetString("domain"),
+				Pageview: job.pageview,
+			})
+		}
+		if slices.Contains(events, WebhookEventGoal) {
+			for _, goal := range goals {
+				w.createDelivery(webhook, WebhookPayload{
+					Event:    WebhookEventGoal,
+					SiteID:   job.site.Id,
+					Domain:   job.site.GetString("domain"),
+					Pageview: job.pageview,
+					Goal:     &goal,
+				})
+			}
+		}
+	}
+}
+
+// createDelivery stores a delivery that is due right away
+func (w *WebhookWorker) createDelivery(webhook *core.Record, payload WebhookPayload) {
+	collection, err := w.app.FindCollectionByNameOrId("webhook_deliveries")
+	if err != nil {
+		webhooksLog.Error("Failed to find webhook_deliveries collection", "error", err)
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		webhooksLog.Error("Failed to encode payload", "webhook", webhook.Id, "error", err)
+		return
+	}
+
+	delivery := core.NewRecord(collection)
+	delivery.Set("webhook", webhook.Id)
+	delivery.Set("site", webhook.GetString("site"))
+	delivery.Set("event", payload.Event)
+	delivery.Set("payload", json.RawMessage(data))
+	delivery.Set("status", "pending")
+	delivery.Set("next_attempt", time.Now().UTC())
+
+	if err := w.app.Save(delivery); err != nil {
+		webhooksLog.Error("Failed to save delivery", "webhook", webhook.Id, "error", err)
+	}
+}
+
+// deliverDue starts sending the pending deliveries whose next attempt is
+// due, oldest first, without waiting for them to finish. Webhooks that
+// already have webhookSendsPerWebhook deliveries in flight are left out, so
+// their backlog doesn't crowd out other webhooks. Deliveries of paused
+// webhooks stay pending until the webhook is resumed.
+func (w *WebhookWorker) deliverDue(ctx context.Context) {
+	w.mu.Lock()
+	var busy []any
+	for webhookId, sending := range w.perWebhook {
+		if sending >= webhookSendsPerWebhook {
+			busy = append(busy, webhookId)
+		}
+	}
+	full := len(w.inFlight) >= webhookSendConcurrency
+	w.mu.Unlock()
+	if full {
+		return
+	}
+
+	var deliveries []*core.Record
+	err := w.app.RecordQuery("webhook_deliveries").
+		AndWhere(dbx.HashExp{"status": "pending"}).
+		AndWhere(dbx.NewExp("next_attempt <= {:now}", dbx.Params{"now": time.Now().UTC().Format(dbTimeLayout)})).
+		AndWhere(dbx.NotIn("webhook", busy...)).
+		AndWhere(dbx.NewExp("webhook IN (SELECT id FROM webhooks WHERE active = TRUE)")).
+		OrderBy("next_attempt").
+		Limit(webhookBatchSize).
+		All(&deliveries)
+	if err != nil {
+		webhooksLog.Error("Failed to load due deliveries", "error", err)
+		return
+	}
+
+	webhooks := map[string]*core.Record{}
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		webhookId := delivery.GetString("webhook")
+		webhook, ok := webhooks[webhookId]
+		if !ok {
+			webhook, _ = w.app.FindRecordById("webhooks", webhookId)
+			webhooks[webhookId] = webhook
+		}
+		if webhook == nil || !webhook.GetBool("active") {
+			continue
+		}
+
+		started, full := w.startSend(webhookId, delivery.Id)
+		if full {
+			return
+		}
+		if !started {
+			continue
+		}
+		w.sends.Go(func() {
+			defer w.finishSend(webhookId, delivery.Id)
+
+			// An attempt that was in flight when the batch was loaded may
+			// have finished since, so send what's stored now
+			current, err := w.app.FindRecordById("webhook_deliveries", delivery.Id)
+			if err != nil || current.GetString("status") != "pending" || current.GetDateTime("next_attempt").Time().After(time.Now()) {
+				return
+			}
+			w.attempt(webhook, current)
+			w.beat()
+		})
+	}
+}
+
+// startSend claims a send slot for a delivery. It reports whether the
+// delivery may be sent, and whether every slot is taken.
+func (w *WebhookWorker) startSend(webhookId, deliveryId string) (started, full bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.inFlight) >= webhookSendConcurrency {
+		return false, true
+	}
+	if w.inFlight[deliveryId] || w.perWebhook[webhookId] >= webhookSendsPerWebhook {
+		return false, false
+	}
+	w.inFlight[deliveryId] = true
+	w.perWebhook[webhookId]++
+	return true, false
+}
+
+// finishSend frees a delivery's send slot and wakes the worker to fill it
+func (w *WebhookWorker) finishSend(webhookId, deliveryId string) {
+	w.mu.Lock()
+	delete(w.inFlight, deliveryId)
+	if w.perWebhook[webhookId]--; w.perWebhook[webhookId] <= 0 {
+		delete(w.perWebhook, webhookId)
+	}
+	w.mu.Unlock()
+	w.Wake()
+}
+
+// attempt sends a delivery once and schedules a retry or marks it failed
+func (w *WebhookWorker) attempt(webhook, delivery *core.Record) {
+	attempts := delivery.GetInt("attempts") + 1
+	status, err := sendWebhook(webhook, delivery)
+
+	delivery.Set("attempts", attempts)
+	delivery.Set("response_status", status)
+	switch {
+	case err == nil:
+		delivery.Set("status", "delivered")
+		delivery.Set("error", "")
+	case attempts >= webhookMaxAttempts:
+		delivery.Set("status", "failed")
+		delivery.Set("error", err.Error())
+		webhooksLog.Warn("Giving up on delivery", "delivery", delivery.Id, "webhook", webhook.Id, "error", err)
+	default:
+		delivery.Set("error", err.Error())
+		delivery.Set("next_attempt", time.Now().UTC().Add(webhookRetryDelay<<(attempts-1)))
+	}
+
+	if err := w.app.Save(delivery); err != nil {
+		webhooksLog.Error("Failed to save delivery", "delivery", delivery.Id, "error", err)
+	}
+}
+
+// sendWebhook POSTs a delivery's payload signed with the webhook secret and
+// returns the response status
+func sendWebhook(webhook, delivery *core.Record) (int, error) {
+	body := []byte(delivery.GetString("payload"))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.GetString("url"), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DingDong-Webhook/1.0")
+	req.Header.Set("X-DingDong-Event", delivery.GetString("event"))
+	req.Header.Set("X-DingDong-Delivery", delivery.Id)
+	req.Header.Set("X-DingDong-Timestamp", timestamp)
+	req.Header.Set("X-DingDong-Signature", "sha256="+SignWebhook(webhook.GetString("secret"), timestamp, body))
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with
+// the webhook secret, as sent in the X-DingDong-Signature header
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PruneWebhookDeliveries deletes finished deliveries created before cutoff
+func PruneWebhookDeliveries(app *pocketbase.PocketBase, before time.Time) (int64, error) {
+	result, err := app.DB().
+		NewQuery("DELETE FROM webhook_deliveries WHERE status != 'pending' AND created < {:before}").
+		Bind(dbx.Params{"before": before.UTC().Format(dbTimeLayout)}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CountPendingWebhookDeliveries counts deliveries that are waiting to be sent or retried
+func CountPendingWebhookDeliveries(app *pocketbase.PocketBase) (int, error) {
+	var count int
+	err := app.DB().NewQuery("SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'pending'").Row(&count)
+	return count, err
+}
+
+// parseWebhookRequest decodes and validates a webhook body
+func parseWebhookRequest(e *core.RequestEvent) (WebhookRequest, error) {
+	var req WebhookRequest
+	if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+		return req, badRequest("Invalid JSON body")
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	if err := validateOutboundURL(e.Request.Context(), req.URL); err != nil {
+		return req, badRequest("url " + err.Error())
+	}
+
+	if len(req.Events) == 0 {
+		return req, badRequest("events must list at least one of: " + strings.Join(WebhookEvents, ", "))
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return req, badRequest("events must only contain: " + strings.Join(WebhookEvents, ", "))
+		}
+	}
+
+	return req, nil
+}
+
+// HandleListWebhooks lists a site's webhooks. Editors and owners may manage them.
+func (h *Handlers) HandleListWebhooks(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	webhooks, err := h.app.FindRecordsByFilter("webhooks", "site = {:site}", "created", 0, 0, dbx.Params{"site": siteId})
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]Webhook, len(webhooks))
+	for i, webhook := range webhooks {
+		result[i] = toWebhook(webhook)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleCreateWebhook adds a webhook to a site with a new signing secret
+func (h *Handlers) HandleCreateWebhook(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	req, err := parseWebhookRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	collection, err := h.app.FindCollectionByNameOrId("webhooks")
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	webhook := core.NewRecord(collection)
+	webhook.Set("site", siteId)
+	webhook.Set("secret", security.RandomString(webhookSecretLength))
+	setWebhook(webhook, req)
+
+	if err := h.app.Save(webhook); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.JSON(http.StatusOK, toWebhook(webhook))
+}
+
+// HandleUpdateWebhook replaces a webhook's URL, events and active flag.
+// The secret is kept.
+func (h *Handlers) HandleUpdateWebhook(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	webhook, err := h.findWebhook(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	req, err := parseWebhookRequest(e)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	setWebhook(webhook, req)
+	if err := h.app.Save(webhook); err != nil {
+		return writeAPIError(e, err)
+	}
+	// A resumed webhook sends the deliveries that waited while it was paused
+	if webhook.GetBool("active") {
+		h.hooks.Wake()
+	}
+
+	return e.JSON(http.StatusOK, toWebhook(webhook))
+}
+
+// HandleDeleteWebhook deletes a webhook and its delivery log
+func (h *Handlers) HandleDeleteWebhook(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	webhook, err := h.findWebhook(e, siteId)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	if err := h.app.Delete(webhook); err != nil {
+		return writeAPIError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// HandleListWebhookDeliveries lists a site's most recent deliveries,
+// optionally only those of ?webhook=<id>
+func (h *Handlers) HandleListWebhookDeliveries(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	filter, params := "site = {:site}", dbx.Params{"site": siteId}
+	if webhookId := e.Request.URL.Query().Get("webhook"); webhookId != "" {
+		filter += " && webhook = {:webhook}"
+		params["webhook"] = webhookId
+	}
+
+	deliveries, err := h.app.FindRecordsByFilter("webhook_deliveries", filter, "-created", webhookDeliveryLimit, 0, params)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	result := make([]WebhookDelivery, len(deliveries))
+	for i, delivery := range deliveries {
+		result[i] = toWebhookDelivery(delivery)
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"site_id": siteId,
+		"results": result,
+	})
+}
+
+// HandleReplayWebhookDelivery queues a new delivery with the same payload as
+// an earlier one, keeping the original in the log
+func (h *Handlers) HandleReplayWebhookDelivery(e *core.RequestEvent) error {
+	siteId := e.Request.PathValue("siteId")
+	if !HasSiteRole(h.app, e.Auth, siteId, RoleEditor) {
+		return writeAPIError(e, &apiError{status: http.StatusForbidden, message: "Only site editors and owners can manage webhooks"})
+	}
+
+	original, err := h.app.FindFirstRecordByFilter("webhook_deliveries", "id = {:id} && site = {:site}", dbx.Params{
+		"id":   e.Request.PathValue("deliveryId"),
+		"site": siteId,
+	})
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Delivery not found"})
+	}
+
+	webhook, err := h.app.FindRecordById("webhooks", original.GetString("webhook"))
+	if err != nil {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Webhook not found"})
+	}
+	if !webhook.GetBool("active") {
+		return writeAPIError(e, badRequest("The webhook is paused, resume it to replay deliveries"))
+	}
+
+	replay := core.NewRecord(original.Collection())
+	replay.Set("webhook", original.GetString("webhook"))
+	replay.Set("site", siteId)
+	replay.Set("event", original.GetString("event"))
+	replay.Set("payload", original.Get("payload"))
+	replay.Set("status", "pending")
+	replay.Set("next_attempt", time.Now().UTC())
+
+	if err := h.app.Save(replay); err != nil {
+		return writeAPIError(e, err)
+	}
+	h.hooks.Wake()
+
+	return e.JSON(http.StatusOK, toWebhookDelivery(replay))
+}
+
+// findWebhook loads the {webhookId} webhook of a site
+func (h *Handlers) findWebhook(e *core.RequestEvent, siteId string) (*core.Record, error) {
+	webhook, err := h.app.FindFirstRecordByFilter("webhooks", "id = {:id} && site = {:site}", dbx.Params{
+		"id":   e.Request.PathValue("webhookId"),
+		"site": siteId,
+	})
+	if err != nil {
+		return nil, &apiError{status: http.StatusNotFound, message: "Webhook not found"}
+	}
+	return webhook, nil
+}
+
+// setWebhook copies a validated request onto a webhooks record
+func setWebhook(webhook *core.Record, req WebhookRequest) {
+	webhook.Set("url", req.URL)
+	webhook.Set("events", req.Events)
+	webhook.Set("active", req.Active == nil || *req.Active)
+}
+
+// toWebhook converts a webhooks record for the webhook endpoints
+func toWebhook(webhook *core.Record) Webhook {
+	return Webhook{
+		ID:      webhook.Id,
+		URL:     webhook.GetString("url"),
+		Secret:  webhook.GetString("secret"),
+		Events:  webhook.GetStringSlice("events"),
+		Active:  webhook.GetBool("active"),
+		Created: webhook.GetDateTime("created").Time().Format(time.RFC3339),
+	}
+}
+
+// toWebhookDelivery converts a webhook_deliveries record for the webhook endpoints
+func toWebhookDelivery(delivery *core.Record) WebhookDelivery {
+	result := WebhookDelivery{
+		ID:             delivery.Id,
+		WebhookID:      delivery.GetString("webhook"),
+		Event:          delivery.GetString("event"),
+		Status:         delivery.GetString("status"),
+		Attempts:       delivery.GetInt("attempts"),
+		ResponseStatus: delivery.GetInt("response_status"),
+		Error:          delivery.GetString("error"),
+		Created:        delivery.GetDateTime("created").Time().Format(time.RFC3339),
+	}
+	if delivery.GetString("status") == "pending" {
+		result.NextAttempt = delivery.GetDateTime("next_attempt").Time().Format(time.RFC3339)
+	}
+	return result
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+//go:embed static/widget.js
+var widgetScript string
+
+// widgetCacheControl lets browsers and CDNs reuse badges and widgets for a few minutes
+const widgetCacheControl = "public, max-age=300, stale-while-revalidate=600"
+
+// WidgetData is passed to widget.html
+type WidgetData struct {
+	Label     string
+	Value     string
+	Range     string
+	Sparkline template.HTML
+}
+
+// widgetStats is what badges and widgets display for a site
+type widgetStats struct {
+	Label  string
+	Value  int
+	Points []TimeseriesPoint
+	Metric string
+}
+
+// ParseRange turns a range like "30d", "24h", "today" or "all" into the
+// query window and a fitting timeseries interval. Badges, widgets and the
+// stats command accept the same ranges.
+func ParseRange(value string) (from, to time.Time, interval string, err error) {
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+
+	switch {
+	case value == "" || value == "30d":
+		return today.AddDate(0, 0, -29), today.AddDate(0, 0, 1), "day", nil
+	case value == "today":
+		return today, today.AddDate(0, 0, 1), "hour", nil
+	case value == "all":
+		return time.Time{}, time.Time{}, "day", nil
+	case strings.HasSuffix(value, "h"):
+		hours, err := strconv.Atoi(strings.TrimSuffix(value, "h"))
+		if err != nil || hours < 1 || hours > 168 {
+			return from, to, "", badRequest("range hours must be between 1h and 168h")
+		}
+		end := now.Truncate(time.Hour).Add(time.Hour)
+		return end.Add(-time.Duration(hours) * time.Hour), end, "hour", nil
+	case strings.HasSuffix(value, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 1 || days > apiMaxTimeseriesDays {
+			return from, to, "", badRequest("range days must be between 1d and 366d")
+		}
+		return today.AddDate(0, 0, -(days - 1)), today.AddDate(0, 0, 1), "day", nil
+	}
+
+	return from, to, "", badRequest("range must be like 30d, 24h, today or all")
+}
+
+// loadWidgetStats finds a site with its public widget enabled and queries the
+// requested metric with the same stats queries as the site stats page
+func (h *Handlers) loadWidgetStats(siteId, metric, rangeParam string) (widgetStats, error) {
+	site, err := h.app.FindRecordById("sites", siteId)
+	if err != nil || !site.GetBool("public_widget") {
+		return widgetStats{}, &apiError{status: http.StatusNotFound, message: "Widget not found"}
+	}
+
+	if metric == "" {
+		metric = "views"
+	}
+	if metric != "views" && metric != "visitors" {
+		return widgetStats{}, badRequest("metric must be views or visitors")
+	}
+
+	from, to, interval, err := ParseRange(rangeParam)
+	if err != nil {
+		return widgetStats{}, err
+	}
+
+	q := StatsQuery{SiteID: site.Id, From: from, To: to}
+	total, err := QueryAggregate(h.app, q)
+	if err != nil {
+		return widgetStats{}, err
+	}
+
+	// "all" has no window of its own, so the sparkline shows the last 30 days
+	if from.IsZero() {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		q.From, q.To = today.AddDate(0, 0, -29), today.AddDate(0, 0, 1)
+	}
+	points, err := QueryTimeseries(h.app, q, interval)
+	if err != nil {
+		return widgetStats{}, err
+	}
+
+	stats := widgetStats{Label: "pageviews", Value: total.Pageviews, Points: points, Metric: metric}
+	if metric == "visitors" {
+		stats.Label, stats.Value = "visitors", total.Visitors
+	}
+
+	return stats, nil
+}
+
+// HandleBadge renders an SVG counter badge at /badge/{siteId}.svg
+func (h *Handlers) HandleBadge(e *core.RequestEvent) error {
+	siteId, ok := strings.CutSuffix(e.Request.PathValue("file"), ".svg")
+	if !ok {
+		return writeAPIError(e, &apiError{status: http.StatusNotFound, message: "Widget not found"})
+	}
+
+	params := e.Request.URL.Query()
+	stats, err := h.loadWidgetStats(siteId, params.Get("metric"), params.Get("range"))
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	label := stats.Label
+	if custom := params.Get("label"); custom != "" && len(custom) <= 40 {
+		label = custom
+	}
+
+	e.Response.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	e.Response.Header().Set("Cache-Control", widgetCacheControl)
+
+	_, err = e.Response.Write([]byte(renderBadge(label, formatCount(stats.Value))))
+	return err
+}
+
+// HandleWidget renders a small iframe-able counter with a sparkline at /widget/{siteId}
+func (h *Handlers) HandleWidget(e *core.RequestEvent) error {
+	params := e.Request.URL.Query()
+	rangeParam := params.Get("range")
+
+	stats, err := h.loadWidgetStats(e.Request.PathValue("siteId"), params.Get("metric"), rangeParam)
+	if err != nil {
+		return writeAPIError(e, err)
+	}
+
+	if rangeParam == "" {
+		rangeParam = "30d"
+	}
+
+	values := make([]int, len(stats.Points))
+	for i, p := range stats.Points {
+		values[i] = p.Pageviews
+		if stats.Metric == "visitors" {
+			values[i] = p.Visitors
+		}
+	}
+
+	// The widget is meant to be framed by other sites
+	e.Response.Header().Del("X-Frame-Options")
+	e.Response.Header().Set("Cache-Control", widgetCacheControl)
+
+	return h.renderTemplate(e, "widget.html", WidgetData{
+		Label:     stats.Label,
+		Value:     formatCount(stats.Value),
+		Range:     rangeParam,
+		Sparkline: template.HTML(renderSparkline(values, 160, 32)),
+	})
+}
+
+// HandleWidgetScript serves the script that inserts the widget iframe
+func (h *Handlers) HandleWidgetScript(e *core.RequestEvent) error {
+	script := strings.ReplaceAll(widgetScript, "{{ENDPOINT}}", GetPublicURL(e))
+
+	e.Response.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	e.Response.Header().Set("Cache-Control", "public, max-age=86400")
+
+	_, err := e.Response.Write([]byte(script))
+	return err
+}
+
+// formatCount abbreviates large numbers for badges, e.g. 12345 -> 12.3k
+func formatCount(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return strconv.FormatFloat(float64(n)/1_000_000, 'f', 1, 64) + "M"
+	case n >= 10_000:
+		return strconv.FormatFloat(float64(n)/1_000, 'f', 1, 64) + "k"
+	}
+	return strconv.Itoa(n)
+}
+
+// renderBadge draws a two-part flat badge. Widths are estimated from the
+// text length since the SVG is rendered without measuring fonts.
+func renderBadge(label, value string) string {
+	const charWidth, padding = 7, 10
+	labelWidth := len(label)*charWidth + padding*2
+	valueWidth := len(value)*charWidth + padding*2
+	width := labelWidth + valueWidth
+
+	label = template.HTMLEscapeString(label)
+	value = template.HTMLEscapeString(value)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[3]d" height="20" fill="#7c3aed"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[6]d" y="14">%[4]s</text>
+<text x="%[7]d" y="14">%[5]s</text>
+</g>
+</svg>`, width, labelWidth, valueWidth, label, value, labelWidth/2, labelWidth+valueWidth/2)
+}
+
+// renderSparkline draws values as an SVG polyline scaled to width x height
+func renderSparkline(values []int, width, height int) string {
+	if len(values) < 2 {
+		return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d"></svg>`, width, height)
+	}
+
+	peak := 1
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+
+	points := make([]string, len(values))
+	step := float64(width) / float64(len(values)-1)
+	for i, v := range values {
+		x := float64(i) * step
+		// Keep a 1px margin so the stroke isn't clipped
+		y := float64(height-1) - float64(v)/float64(peak)*float64(height-2)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d"><polyline fill="none" stroke="#a855f7" stroke-width="1.5" points="%s"/></svg>`,
+		width, height, width, height, strings.Join(points, " "))
+}
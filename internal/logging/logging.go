@@ -0,0 +1,200 @@
+// Package logging sets up DingDong's structured logger. Log lines are written
+// with slog as JSON or text, carry the request ID of the HTTP request they
+// belong to, and name the part of DingDong that wrote them.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Log formats for LOG_FORMAT
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// MaxBodyLength is how much of a request body Body keeps
+const MaxBodyLength = 200
+
+// DefaultPingSample is the default LOG_PING_SAMPLE
+const DefaultPingSample = 10
+
+var (
+	// current is the handler every logger writes to. Loggers made with
+	// Component before Setup runs pick up the configured handler.
+	current atomic.Pointer[slog.Handler]
+
+	// pings samples the routine log lines of /api/ping
+	pings atomic.Pointer[Sampler]
+)
+
+func init() {
+	setHandler(slog.NewTextHandler(os.Stderr, nil))
+	pings.Store(NewSampler(1))
+}
+
+func setHandler(h slog.Handler) {
+	current.Store(&h)
+}
+
+// Options configures the logger
+type Options struct {
+	Level  slog.Level
+	Format string
+	// PingSample logs one in this many routine ping lines. Errors are always logged.
+	PingSample int
+}
+
+// OptionsFromEnv reads LOG_LEVEL (debug, info, warn or error), LOG_FORMAT
+// (json or text) and LOG_PING_SAMPLE
+func OptionsFromEnv() (Options, error) {
+	opts := Options{Level: slog.LevelInfo, Format: FormatJSON, PingSample: DefaultPingSample}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := opts.Level.UnmarshalText([]byte(level)); err != nil {
+			return opts, fmt.Errorf("invalid LOG_LEVEL %q: use debug, info, warn or error", level)
+		}
+	}
+
+	if format := strings.ToLower(os.Getenv("LOG_FORMAT")); format != "" {
+		if format != FormatJSON && format != FormatText {
+			return opts, fmt.Errorf("invalid LOG_FORMAT %q: use json or text", format)
+		}
+		opts.Format = format
+	}
+
+	if sample := os.Getenv("LOG_PING_SAMPLE"); sample != "" {
+		n, err := strconv.Atoi(sample)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid LOG_PING_SAMPLE %q: use a whole number of 1 or more", sample)
+		}
+		opts.PingSample = n
+	}
+
+	return opts, nil
+}
+
+// Setup writes logs to w and makes them the default slog and log output
+func Setup(w io.Writer, opts Options) {
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+
+	var h slog.Handler
+	if opts.Format == FormatText {
+		h = slog.NewTextHandler(w, handlerOpts)
+	} else {
+		h = slog.NewJSONHandler(w, handlerOpts)
+	}
+	setHandler(h)
+
+	// Debug logging is for seeing everything
+	sample := opts.PingSample
+	if opts.Level <= slog.LevelDebug {
+		sample = 1
+	}
+	pings.Store(NewSampler(sample))
+
+	slog.SetDefault(slog.New(&handler{}))
+}
+
+// SamplePing reports whether a routine /api/ping log line should be written
+func SamplePing() bool {
+	return pings.Load().Allow()
+}
+
+// Component returns a logger whose lines are tagged with the component name
+func Component(name string) *slog.Logger {
+	return slog.New(&handler{}).With("component", name)
+}
+
+// handler adds the request ID from the context and forwards to the current handler
+type handler struct {
+	// with replays WithAttrs and WithGroup calls on the current handler
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) base() slog.Handler {
+	base := *current.Load()
+	for _, with := range h.with {
+		base = with(base)
+	}
+	return base
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return (*current.Load()).Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.base().Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(base slog.Handler) slog.Handler { return base.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.extend(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+func (h *handler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &handler{with: append(append([]func(slog.Handler) slog.Handler(nil), h.with...), with)}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Body returns the start of a request body, so a large or hostile body
+// can't flood the logs
+func Body(body []byte) string {
+	if len(body) > MaxBodyLength {
+		return strings.ToValidUTF8(string(body[:MaxBodyLength]), "") + "…"
+	}
+	return string(body)
+}
+
+// Path returns a URL path without its query string or fragment, which can
+// carry emails, tokens and other things that don't belong in logs
+func Path(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	path, _, _ = strings.Cut(path, "#")
+	return path
+}
+
+// Sampler lets through one in every n events
+type Sampler struct {
+	every uint64
+	count atomic.Uint64
+}
+
+// NewSampler returns a sampler that allows one in every n events. n <= 1 allows all.
+func NewSampler(n int) *Sampler {
+	if n < 1 {
+		n = 1
+	}
+	return &Sampler{every: uint64(n)}
+}
+
+// Allow reports whether this event should be logged. The first event is always allowed.
+func (s *Sampler) Allow() bool {
+	return (s.count.Add(1)-1)%s.every == 0
+}
@@ -0,0 +1,278 @@
+// Package metrics keeps DingDong's Prometheus metrics and writes them in the
+// text exposition format. Counters, histograms and gauges read at scrape time
+// are all DingDong needs, so it doesn't pull in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Content-Type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets in seconds suited to HTTP request latency
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Ping outcomes for the Pings counter
+const (
+	PingAccepted = "accepted"
+	PingDenied   = "denied"
+	PingInvalid  = "invalid"
+	PingIgnored  = "ignored"
+	PingError    = "error"
+)
+
+// Lookup results for the StatsCache counter
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// UnknownSite is the site label for pings from domains that aren't registered,
+// so arbitrary origins can't create new series
+const UnknownSite = "unknown"
+
+var (
+	// Pings counts /api/ping requests by site domain, outcome and reason
+	Pings = NewCounterVec("dingdong_pings_total", "Pageview pings received by site, outcome and reason.", "site", "outcome", "reason")
+
+	// RequestDuration tracks request latency of the ingestion, tracker and dashboard routes
+	RequestDuration = NewHistogramVec("dingdong_http_request_duration_seconds", "HTTP request latency by route and status code.", DefaultBuckets, "route", "code")
+
+	// StatsCache counts stats query cache lookups by query and result
+	StatsCache = NewCounterVec("dingdong_stats_cache_requests_total", "Stats query cache lookups by query and result.", "query", "result")
+)
+
+// collector is a registered metric family
+type collector interface {
+	write(w io.Writer) error
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// Write writes every registered metric in registration order
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds 1 to the series with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series with the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key)), formatValue(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with ascending buckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := splitKey(key)
+		labels := append(append([]string(nil), h.labels...), "le")
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, formatValue(upper))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge whose series are read when metrics are scraped
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(set func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc creates and registers a gauge. collect calls set once per series.
+func NewGaugeFunc(name, help string, collect func(set func(v float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	writeHeader(w, g.name, g.help, "gauge")
+
+	var err error
+	g.collect(func(v float64, labelValues ...string) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelValues), formatValue(v))
+		}
+	})
+	return err
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+// seriesKey joins label values into a map key. \xff can't appear in UTF-8.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,98 @@
+package migrations
+
+import (
+	"slices"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The initial schema is everything DingDong created on startup before it had
+// versioned migrations. Each step skips what already exists and adds missing
+// fields, so databases set up by older versions are adopted as they are.
+func init() {
+	register("1792281600_initial_schema.go", func(app core.App) error {
+		// Create sites collection (registered domains)
+		if err := createSitesCollection(app); err != nil {
+			return err
+		}
+
+		// Migrate existing sites collection to add new fields
+		if err := migrateSitesCollection(app); err != nil {
+			return err
+		}
+
+		// Create pageviews collection (analytics data)
+		if err := createPageviewsCollection(app); err != nil {
+			return err
+		}
+
+		// Migrate existing pageviews collection to add new fields
+		if err := migratePageviewsCollection(app); err != nil {
+			return err
+		}
+
+		// Create denied_pageviews collection (tracking denied requests)
+		if err := createDeniedPageviewsCollection(app); err != nil {
+			return err
+		}
+
+		// Create privacy_optouts collection (aggregate DNT/GPC counters)
+		if err := createPrivacyOptoutsCollection(app); err != nil {
+			return err
+		}
+
+		// Create api_tokens collection (scoped API access)
+		if err := createAPITokensCollection(app); err != nil {
+			return err
+		}
+
+		// Create site_members collection (per-site user roles)
+		if err := createSiteMembersCollection(app); err != nil {
+			return err
+		}
+
+		// Create share_links collection (public read-only dashboards)
+		if err := createShareLinksCollection(app); err != nil {
+			return err
+		}
+
+		// Create imported_stats collection (daily rollups imported from other tools)
+		if err := createImportedStatsCollection(app); err != nil {
+			return err
+		}
+
+		// Create report_subscriptions collection (scheduled email digests)
+		if err := createReportSubscriptionsCollection(app); err != nil {
+			return err
+		}
+
+		// Create alert_rules and alert_events collections (traffic alerts and their history)
+		if err := createAlertCollections(app); err != nil {
+			return err
+		}
+
+		// Create webhooks and webhook_deliveries collections (outgoing pageview and goal webhooks)
+		if err := createWebhookCollections(app); err != nil {
+			return err
+		}
+
+		// Let site members read sites and pageviews through the PocketBase API
+		if err := applySiteMemberRules(app); err != nil {
+			return err
+		}
+
+		return nil
+	}, func(app core.App) error {
+		// Drop collections before the ones their relations point to
+		for _, name := range slices.Backward(Collections) {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Stats queries filter pageviews by site and a created range. A composite
+// index serves them directly, and also covers site-only lookups, so it
+// replaces idx_pageviews_site.
+func init() {
+	register("1792324800_pageviews_site_created_index.go", func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("pageviews")
+		if err != nil {
+			return err
+		}
+
+		collection.RemoveIndex("idx_pageviews_site")
+		collection.AddIndex("idx_pageviews_site_created", false, "site, created", "")
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("pageviews")
+		if err != nil {
+			return err
+		}
+
+		collection.RemoveIndex("idx_pageviews_site_created")
+		collection.AddIndex("idx_pageviews_site", false, "site", "")
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// pageview_hourly holds pre-aggregated pageview counts per site and hour, so
+// the dashboard's totals and charts don't scan a site's whole history. The
+// counters are backfilled from the existing pageviews.
+func init() {
+	register("1792328400_pageview_hourly.go", func(app core.App) error {
+		sitesCollection, err := app.FindCollectionByNameOrId("sites")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("pageview_hourly")
+
+		// Admin only access
+		collection.ListRule = nil
+		collection.ViewRule = nil
+		collection.CreateRule = nil
+		collection.UpdateRule = nil
+		collection.DeleteRule = nil
+
+		collection.Fields.Add(&core.RelationField{
+			Name:          "site",
+			Required:      true,
+			CollectionId:  sitesCollection.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+
+		// Start of the hour, in UTC
+		collection.Fields.Add(&core.DateField{
+			Name:     "hour",
+			Required: true,
+		})
+
+		// Non-spam pageviews created during the hour
+		collection.Fields.Add(&core.NumberField{
+			Name:    "pageviews",
+			OnlyInt: true,
+		})
+
+		collection.Fields.Add(&core.AutodateField{
+			Name:     "created",
+			OnCreate: true,
+		})
+
+		collection.Fields.Add(&core.AutodateField{
+			Name:     "updated",
+			OnCreate: true,
+			OnUpdate: true,
+		})
+
+		// One counter row per site and hour; the hour index finds the newest rollup
+		collection.AddIndex("idx_pageview_hourly_site_hour", true, "site, hour", "")
+		collection.AddIndex("idx_pageview_hourly_hour", false, "hour", "")
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+
+		return backfillPageviewHourly(app)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("pageview_hourly")
+		if err != nil {
+			return err
+		}
+		return app.Delete(collection)
+	})
+}
+
+// backfillPageviewHourly counts the non-spam pageviews of every completed hour
+// into pageview_hourly. The current hour is left to the hourly rollup.
+func backfillPageviewHourly(app core.App) error {
+	now := time.Now().UTC()
+	_, err := app.DB().
+		NewQuery("INSERT INTO pageview_hourly (site, hour, pageviews, created, updated) " +
+			"SELECT site, strftime('%Y-%m-%d %H:00:00.000Z', created) as hour, COUNT(*), {:now}, {:now} FROM pageviews " +
+			"WHERE spam = FALSE AND created < {:to} GROUP BY site, hour").
+		Bind(dbx.Params{
+			"now": now.Format(types.DefaultDateLayout),
+			"to":  now.Truncate(time.Hour).Format(types.DefaultDateLayout),
+		}).
+		Execute()
+	return err
+}
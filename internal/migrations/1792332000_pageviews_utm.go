@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// utmFields are the campaign parameters the tracker sends in each path's query string
+var utmFields = []string{"utm_source", "utm_medium", "utm_campaign"}
+
+// Pageviews store their UTM parameters, so stats can be filtered and broken
+// down by campaign. Existing pageviews are backfilled from their paths.
+func init() {
+	register("1792332000_pageviews_utm.go", func(app core.App) error {
+		fields := make([]core.Field, len(utmFields))
+		for i, name := range utmFields {
+			fields[i] = &core.TextField{Name: name, Max: 255}
+		}
+		if err := addMissingFields(app, "pageviews", fields...); err != nil {
+			return err
+		}
+
+		return backfillUTMFields(app)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("pageviews")
+		if err != nil {
+			return err
+		}
+
+		for _, name := range utmFields {
+			collection.Fields.RemoveByName(name)
+		}
+		return app.Save(collection)
+	})
+}
+
+// backfillUTMFields derives the UTM fields of existing pageviews. It runs one
+// UPDATE per distinct path with UTM parameters rather than per row.
+func backfillUTMFields(app core.App) error {
+	var paths []string
+	err := app.DB().
+		NewQuery(`SELECT DISTINCT path FROM pageviews WHERE path LIKE '%utm\_%' ESCAPE '\'`).
+		Column(&paths)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		utm := parseUTM(path)
+		_, err := app.DB().
+			NewQuery("UPDATE pageviews SET utm_source = {:source}, utm_medium = {:medium}, utm_campaign = {:campaign} WHERE path = {:path}").
+			Bind(map[string]any{"source": utm.Source, "medium": utm.Medium, "campaign": utm.Campaign, "path": path}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
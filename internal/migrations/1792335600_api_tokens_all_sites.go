@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// API tokens grant access to every site through an explicit all_sites flag
+// instead of an empty sites list. The sites relation doesn't cascade, so
+// deleting a token's only site used to empty the list and silently widen the
+// token to every site. Tokens that currently have no sites were created as
+// all-sites tokens and keep that access.
+func init() {
+	register("1792335600_api_tokens_all_sites.go", func(app core.App) error {
+		err := addMissingFields(app, "api_tokens", &core.BoolField{Name: "all_sites"})
+		if err != nil {
+			return err
+		}
+
+		_, err = app.DB().
+			NewQuery("UPDATE api_tokens SET all_sites = TRUE WHERE sites IS NULL OR sites = '' OR sites = '[]'").
+			Execute()
+		return err
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("api_tokens")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("all_sites")
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Traffic source names from Plausible's sources table and GA4's "Session
+// source" ("Google", "news.ycombinator.com") were imported as referrers,
+// which are full URLs, duplicating rows in top referrers. They move to their
+// own source dimension. Every Plausible referrer row came from the sources
+// table; GA4 "Page referrer" rows are URLs and stay.
+func init() {
+	register("1792339200_imported_sources.go", func(app core.App) error {
+		_, err := app.DB().
+			NewQuery("UPDATE imported_stats SET dimension = 'source' WHERE dimension = 'referrer' AND (source = 'plausible' OR (source = 'ga4' AND value NOT LIKE 'http%'))").
+			Execute()
+		return err
+	}, func(app core.App) error {
+		_, err := app.DB().
+			NewQuery("UPDATE imported_stats SET dimension = 'referrer' WHERE dimension = 'source'").
+			Execute()
+		return err
+	})
+}
@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// user_report_subscriptions holds per-user email digests, one email covering
+// every site the recipient can view. Users and superusers live in different
+// collections, so each subscription links exactly one of the two.
+func init() {
+	register("1792342800_user_report_subscriptions.go", func(app core.App) error {
+		usersCollection, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		superusers, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("user_report_subscriptions")
+
+		// Admin only access; users subscribe through the report endpoints
+		collection.ListRule = nil
+		collection.ViewRule = nil
+		collection.CreateRule = nil
+		collection.UpdateRule = nil
+		collection.DeleteRule = nil
+
+		collection.Fields.Add(&core.RelationField{
+			Name:          "user",
+			CollectionId:  usersCollection.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+
+		collection.Fields.Add(&core.RelationField{
+			Name:          "superuser",
+			CollectionId:  superusers.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+
+		collection.Fields.Add(&core.SelectField{
+			Name:      "frequency",
+			Required:  true,
+			MaxSelect: 1,
+			Values:    []string{"weekly", "monthly"},
+		})
+
+		// End of the last period sent, so a missed hour or restart never sends twice
+		collection.Fields.Add(&core.DateField{
+			Name: "last_sent",
+		})
+
+		collection.Fields.Add(&core.AutodateField{
+			Name:     "created",
+			OnCreate: true,
+		})
+
+		collection.Fields.Add(&core.AutodateField{
+			Name:     "updated",
+			OnCreate: true,
+			OnUpdate: true,
+		})
+
+		collection.AddIndex("idx_user_report_subscriptions_user", true, "user, frequency", "user != ''")
+		collection.AddIndex("idx_user_report_subscriptions_superuser", true, "superuser, frequency", "superuser != ''")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("user_report_subscriptions")
+		if err != nil {
+			return err
+		}
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Site reports can be sent to addresses without an account, which can't sign
+// in to unsubscribe. Each subscription gets a secret that signs the
+// confirmation and unsubscribe links in its emails, and addresses that don't
+// belong to a member only get reports once they confirm. Existing
+// subscriptions were already receiving reports and stay confirmed.
+func init() {
+	register("1792346400_report_subscription_confirmation.go", func(app core.App) error {
+		err := addMissingFields(app, "report_subscriptions",
+			&core.BoolField{Name: "confirmed"},
+			// HMAC-SHA256 key for the confirmation and unsubscribe links
+			&core.TextField{Name: "secret", Hidden: true},
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = app.DB().
+			NewQuery("UPDATE report_subscriptions SET confirmed = TRUE, secret = lower(hex(randomblob(32))) WHERE secret = ''").
+			Execute()
+		return err
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("report_subscriptions")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("confirmed")
+		collection.Fields.RemoveByName("secret")
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// cache_generations holds counters that are bumped whenever cached results
+// go stale. CLI commands such as prune and import change pageviews from
+// their own process, so they can't clear the server's in-memory stats cache
+// directly; the server watches the "stats" counter instead.
+func init() {
+	register("1792350000_cache_generations.go", func(app core.App) error {
+		collection := core.NewBaseCollection("cache_generations")
+
+		// Admin only access
+		collection.ListRule = nil
+		collection.ViewRule = nil
+		collection.CreateRule = nil
+		collection.UpdateRule = nil
+		collection.DeleteRule = nil
+
+		collection.Fields.Add(&core.TextField{
+			Name:     "name",
+			Required: true,
+			Max:      64,
+		})
+
+		collection.Fields.Add(&core.NumberField{
+			Name:    "generation",
+			OnlyInt: true,
+		})
+
+		collection.AddIndex("idx_cache_generations_name", true, "name", "")
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+
+		stats := core.NewRecord(collection)
+		stats.Set("name", "stats")
+		return app.Save(stats)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("cache_generations")
+		if err != nil {
+			return err
+		}
+		return app.Delete(collection)
+	})
+}
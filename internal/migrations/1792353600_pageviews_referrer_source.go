@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Pageviews store the host of their referrer, so stats can be filtered and
+// broken down by referring site rather than by every distinct referrer URL.
+// Existing pageviews are backfilled from their referrers.
+func init() {
+	register("1792353600_pageviews_referrer_source.go", func(app core.App) error {
+		err := addMissingFields(app, "pageviews", &core.TextField{Name: "referrer_source", Max: 255})
+		if err != nil {
+			return err
+		}
+
+		return backfillReferrerSource(app)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("pageviews")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("referrer_source")
+		return app.Save(collection)
+	})
+}
+
+// backfillReferrerSource derives the referrer_source of existing pageviews.
+// It runs one UPDATE per distinct referrer rather than per row.
+func backfillReferrerSource(app core.App) error {
+	var referrers []string
+	err := app.DB().
+		NewQuery("SELECT DISTINCT referrer FROM pageviews WHERE referrer != ''").
+		Column(&referrers)
+	if err != nil {
+		return err
+	}
+
+	for _, referrer := range referrers {
+		source := referrerSource(referrer)
+		if source == "" {
+			continue
+		}
+		_, err := app.DB().
+			NewQuery("UPDATE pageviews SET referrer_source = {:source} WHERE referrer = {:referrer}").
+			Bind(map[string]any{"source": source, "referrer": referrer}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,40 +1,122 @@
 package migrations
 
 import (
+	"fmt"
+	"slices"
+
+	"github.com/abigpotostew/dingdong/internal/logging"
+
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/plugins/migratecmd"
 )
 
-// Register sets up database migrations for the stats tracking schema
+var migrationsLog = logging.Component("migrations")
+
+// Collections are the collections DingDong's migrations create
+var Collections = []string{
+	"sites",
+	"pageviews",
+	"denied_pageviews",
+	"privacy_optouts",
+	"api_tokens",
+	"site_members",
+	"share_links",
+	"imported_stats",
+	"report_subscriptions",
+	"alert_rules",
+	"alert_events",
+	"webhooks",
+	"webhook_deliveries",
+	"pageview_hourly",
+	"user_report_subscriptions",
+	"cache_generations",
+}
+
+// files are DingDong's migrations, named as in the _migrations table
+var files []string
+
+// register adds a migration to PocketBase's app migrations. Migrations run in
+// file name order, so names start with the Unix time they were written.
+func register(file string, up, down func(app core.App) error) {
+	files = append(files, file)
+	m.Register(up, down, file)
+}
+
+// Register runs pending migrations whenever the app bootstraps, so CLI
+// commands see the same schema as the server, and adds the migrate command
+// (up, down [n], history-sync)
 func Register(app *pocketbase.PocketBase) {
-	// Create collections on app bootstrap
-	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
-		// Create sites collection (registered domains)
-		if err := createSitesCollection(app); err != nil {
-			return err
-		}
+	migratecmd.MustRegister(app, app.RootCmd, migratecmd.Config{})
 
-		// Migrate existing sites collection to add new fields
-		if err := migrateSitesCollection(app); err != nil {
+	app.OnBootstrap().BindFunc(func(e *core.BootstrapEvent) error {
+		if err := e.Next(); err != nil {
 			return err
 		}
 
-		// Create pageviews collection (analytics data)
-		if err := createPageviewsCollection(app); err != nil {
-			return err
+		applied, err := core.NewMigrationsRunner(e.App, core.AppMigrations).Up()
+		for _, file := range applied {
+			migrationsLog.Info("Applied migration", "file", file)
 		}
+		return err
+	})
+}
 
-		// Create denied_pageviews collection (tracking denied requests)
-		if err := createDeniedPageviewsCollection(app); err != nil {
-			return err
+// SchemaStatus is the schema version of a database
+type SchemaStatus struct {
+	// Version is the latest DingDong migration applied to the database
+	Version string `json:"schema_version"`
+	// Latest is the latest DingDong migration in this build
+	Latest  string   `json:"latest"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// Status reads the applied migrations from the _migrations table
+func Status(app core.App) (SchemaStatus, error) {
+	var status SchemaStatus
+
+	var applied []string
+	if err := app.DB().NewQuery("SELECT file FROM _migrations").Column(&applied); err != nil {
+		return status, err
+	}
+
+	sorted := slices.Sorted(slices.Values(files))
+	for _, file := range sorted {
+		if slices.Contains(applied, file) {
+			status.Version = file
+		} else {
+			status.Pending = append(status.Pending, file)
 		}
+	}
+	if len(sorted) > 0 {
+		status.Latest = sorted[len(sorted)-1]
+	}
 
-		return e.Next()
-	})
+	return status, nil
+}
+
+// Check returns the schema status and an error if migrations are pending or
+// one of DingDong's collections has gone missing since they ran
+func Check(app core.App) (SchemaStatus, error) {
+	status, err := Status(app)
+	if err != nil {
+		return status, err
+	}
+	if len(status.Pending) > 0 {
+		return status, fmt.Errorf("%d migrations pending", len(status.Pending))
+	}
+
+	for _, name := range Collections {
+		if _, err := app.FindCachedCollectionByNameOrId(name); err != nil {
+			return status, fmt.Errorf("collection %s is missing", name)
+		}
+	}
+	return status, nil
 }
 
 // createSitesCollection creates the sites collection for registered domains
-func createSitesCollection(app *pocketbase.PocketBase) error {
+func createSitesCollection(app core.App) error {
 	// Check if collection already exists
 	existing, _ := app.FindCollectionByNameOrId("sites")
 	if existing != nil {
@@ -72,6 +154,17 @@ func createSitesCollection(app *pocketbase.PocketBase) error {
 		Max:  1024,
 	})
 
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
 	// Add index
 	collection.AddIndex("idx_sites_domain", false, "domain", "")
 
@@ -79,28 +172,165 @@ func createSitesCollection(app *pocketbase.PocketBase) error {
 }
 
 // migrateSitesCollection adds new fields to existing sites collection
-func migrateSitesCollection(app *pocketbase.PocketBase) error {
-	collection, err := app.FindCollectionByNameOrId("sites")
+func migrateSitesCollection(app core.App) error {
+	return addMissingFields(app, "sites",
+		&core.TextField{
+			Name: "additional_domains",
+			Max:  1024,
+		},
+		&core.TextField{
+			Name: "referrer_blocklist",
+			Max:  4096,
+		},
+		&core.SelectField{
+			Name:      "referrer_spam_action",
+			Values:    []string{"reject", "flag"},
+			MaxSelect: 1,
+		},
+		&core.TextField{
+			Name: "excluded_ips",
+			Max:  4096,
+		},
+		&core.SelectField{
+			Name:      "privacy_signals",
+			Values:    []string{"ignore", "drop", "anonymize"},
+			MaxSelect: 1,
+		},
+		&core.BoolField{
+			Name: "public_widget",
+		},
+		// IANA time zone name, e.g. Europe/Berlin
+		&core.TextField{
+			Name: "timezone",
+			Max:  64,
+		},
+		// List of {"name", "path"} conversion goals
+		&core.JSONField{
+			Name:    "goals",
+			MaxSize: 65536,
+		},
+		// Pageviews older than this many days are pruned daily; 0 keeps them forever
+		&core.NumberField{
+			Name:    "retention_days",
+			OnlyInt: true,
+		},
+		// Set for sites defined in dingdong.yaml, which overwrites their settings on startup
+		&core.BoolField{
+			Name: "managed",
+		},
+	)
+}
+
+// migratePageviewsCollection adds new fields to existing pageviews collection
+func migratePageviewsCollection(app core.App) error {
+	collection, err := app.FindCollectionByNameOrId("pageviews")
 	if err != nil {
 		return nil // Collection doesn't exist, nothing to migrate
 	}
+	needsUserAgentBackfill := collection.Fields.GetByName("browser") == nil
 
-	// Check if additional_domains field already exists
-	if collection.Fields.GetByName("additional_domains") != nil {
-		return nil // Already migrated
+	err = addMissingFields(app, "pageviews",
+		&core.BoolField{
+			Name: "spam",
+		},
+		&core.TextField{
+			Name: "browser",
+			Max:  64,
+		},
+		&core.TextField{
+			Name: "os",
+			Max:  64,
+		},
+		&core.TextField{
+			Name: "device",
+			Max:  32,
+		},
+		// SHA-256 of the access log line a pageview was imported from
+		&core.TextField{
+			Name:   "import_hash",
+			Hidden: true,
+			Max:    64,
+		},
+	)
+	if err != nil {
+		return err
 	}
 
-	// Add the additional_domains field
-	collection.Fields.Add(&core.TextField{
-		Name: "additional_domains",
-		Max:  1024,
-	})
+	if err := addImportHashIndex(app); err != nil {
+		return err
+	}
+
+	if needsUserAgentBackfill {
+		return backfillUserAgentFields(app)
+	}
+	return nil
+}
+
+// addImportHashIndex makes access log imports idempotent. Tracked pageviews
+// have no import hash, so the index only covers imported ones.
+func addImportHashIndex(app core.App) error {
+	collection, err := app.FindCollectionByNameOrId("pageviews")
+	if err != nil {
+		return err
+	}
+	if collection.GetIndex("idx_pageviews_import_hash") != "" {
+		return nil
+	}
+
+	collection.AddIndex("idx_pageviews_import_hash", true, "import_hash", "import_hash != ''")
+	return app.Save(collection)
+}
+
+// backfillUserAgentFields derives browser, os and device for existing pageviews.
+// It runs one UPDATE per distinct user agent rather than per row.
+func backfillUserAgentFields(app core.App) error {
+	var userAgents []string
+	err := app.DB().
+		NewQuery("SELECT DISTINCT user_agent FROM pageviews WHERE user_agent != ''").
+		Column(&userAgents)
+	if err != nil {
+		return err
+	}
+
+	for _, ua := range userAgents {
+		info := parseUserAgent(ua)
+		_, err := app.DB().
+			NewQuery("UPDATE pageviews SET browser = {:browser}, os = {:os}, device = {:device} WHERE user_agent = {:ua}").
+			Bind(map[string]any{"browser": info.Browser, "os": info.OS, "device": info.Device, "ua": ua}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addMissingFields adds the given fields to a collection if they don't exist yet
+func addMissingFields(app core.App, name string, fields ...core.Field) error {
+	collection, err := app.FindCollectionByNameOrId(name)
+	if err != nil {
+		return nil // Collection doesn't exist, nothing to migrate
+	}
+
+	changed := false
+	for _, field := range fields {
+		if collection.Fields.GetByName(field.GetName()) != nil {
+			continue // Already migrated
+		}
+		collection.Fields.Add(field)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
 
 	return app.Save(collection)
 }
 
 // createPageviewsCollection creates the pageviews collection for analytics
-func createPageviewsCollection(app *pocketbase.PocketBase) error {
+func createPageviewsCollection(app core.App) error {
 	// Check if collection already exists
 	existing, _ := app.FindCollectionByNameOrId("pageviews")
 	if existing != nil {
@@ -165,6 +395,17 @@ func createPageviewsCollection(app *pocketbase.PocketBase) error {
 		Name: "screen_height",
 	})
 
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
 	// Add indexes
 	collection.AddIndex("idx_pageviews_site", false, "site", "")
 	collection.AddIndex("idx_pageviews_created", false, "created", "")
@@ -174,7 +415,7 @@ func createPageviewsCollection(app *pocketbase.PocketBase) error {
 }
 
 // createDeniedPageviewsCollection creates a collection to track denied/unauthorized requests
-func createDeniedPageviewsCollection(app *pocketbase.PocketBase) error {
+func createDeniedPageviewsCollection(app core.App) error {
 	// Check if collection already exists
 	existing, _ := app.FindCollectionByNameOrId("denied_pageviews")
 	if existing != nil {
@@ -237,9 +478,831 @@ func createDeniedPageviewsCollection(app *pocketbase.PocketBase) error {
 		Name: "screen_height",
 	})
 
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
 	// Add indexes (note: 'created' is a system field, can't index before save)
 	collection.AddIndex("idx_denied_domain", false, "domain", "")
 	collection.AddIndex("idx_denied_reason", false, "reason", "")
 
 	return app.Save(collection)
 }
+
+// createPrivacyOptoutsCollection creates the daily aggregate counters of pings
+// that carried a Do Not Track or Global Privacy Control signal
+func createPrivacyOptoutsCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("privacy_optouts")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("privacy_optouts")
+
+	// Admin only access
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "day",
+		Required: true,
+		Max:      10,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "dropped",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "anonymized",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	// One counter row per site and day
+	collection.AddIndex("idx_privacy_optouts_site_day", true, "site, day", "")
+
+	return app.Save(collection)
+}
+
+// createAPITokensCollection creates the api_tokens collection for scoped API access.
+// Only the SHA-256 of each token is stored; the plaintext is shown once on creation.
+func createAPITokensCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("api_tokens")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	superusers, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("api_tokens")
+
+	// Admin only access
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.TextField{
+		Name:     "name",
+		Required: true,
+		Max:      255,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "token_hash",
+		Required: true,
+		Hidden:   true,
+		Max:      64,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "token_prefix",
+		Max:  16,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "owner",
+		CollectionId:  superusers.Id,
+		MaxSelect:     1,
+		CascadeDelete: false,
+	})
+
+	// Sites the token may access, unless it's granted all sites
+	collection.Fields.Add(&core.RelationField{
+		Name:          "sites",
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     999,
+		CascadeDelete: false,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "scopes",
+		Required:  true,
+		Values:    []string{"stats:read", "events:write"},
+		MaxSelect: 2,
+	})
+
+	collection.Fields.Add(&core.DateField{
+		Name: "expires",
+	})
+
+	collection.Fields.Add(&core.DateField{
+		Name: "last_used",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_api_tokens_token_hash", true, "token_hash", "")
+
+	return app.Save(collection)
+}
+
+// createSiteMembersCollection creates the site_members collection linking
+// users to the sites they can access and their role on each
+func createSiteMembersCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("site_members")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	usersCollection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("site_members")
+
+	// Users can see their own memberships; changes go through the members endpoints
+	ownRule := "user = @request.auth.id"
+	collection.ListRule = &ownRule
+	collection.ViewRule = &ownRule
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "user",
+		Required:      true,
+		CollectionId:  usersCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "role",
+		Required:  true,
+		Values:    []string{"owner", "editor", "viewer"},
+		MaxSelect: 1,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_site_members_site_user", true, "site, user", "")
+	collection.AddIndex("idx_site_members_user", false, "user", "")
+
+	return app.Save(collection)
+}
+
+// applySiteMemberRules opens the sites and pageviews collections to site
+// members according to their role. Rules are only set while they're still
+// the superuser-only default, so changes made in the PocketBase UI are kept.
+func applySiteMemberRules(app core.App) error {
+	member := "@collection.site_members.site ?= id && @collection.site_members.user ?= @request.auth.id"
+	editor := member + ` && (@collection.site_members.role ?= "owner" || @collection.site_members.role ?= "editor")`
+	owner := member + ` && @collection.site_members.role ?= "owner"`
+	pageviewMember := "@collection.site_members.site ?= site && @collection.site_members.user ?= @request.auth.id"
+
+	sites, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	// Creating sites stays superuser-only; owners and superusers add members
+	changed := setDefaultRule(&sites.ListRule, member)
+	changed = setDefaultRule(&sites.ViewRule, member) || changed
+	changed = setDefaultRule(&sites.UpdateRule, editor) || changed
+	changed = setDefaultRule(&sites.DeleteRule, owner) || changed
+	if changed {
+		if err := app.Save(sites); err != nil {
+			return err
+		}
+	}
+
+	pageviews, err := app.FindCollectionByNameOrId("pageviews")
+	if err != nil {
+		return err
+	}
+
+	changed = setDefaultRule(&pageviews.ListRule, pageviewMember)
+	changed = setDefaultRule(&pageviews.ViewRule, pageviewMember) || changed
+	if changed {
+		return app.Save(pageviews)
+	}
+
+	return nil
+}
+
+// setDefaultRule sets a collection API rule if it's still nil (superuser-only)
+func setDefaultRule(rule **string, value string) bool {
+	if *rule != nil {
+		return false
+	}
+	*rule = &value
+	return true
+}
+
+// createShareLinksCollection creates the share_links collection for public,
+// read-only site dashboards at /share/{slug}
+func createShareLinksCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("share_links")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("share_links")
+
+	// Admin only access; editors manage links through the share endpoints
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "label",
+		Max:  255,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "slug",
+		Required: true,
+		Max:      64,
+	})
+
+	// bcrypt hash; empty means no password
+	collection.Fields.Add(&core.TextField{
+		Name:   "password_hash",
+		Hidden: true,
+		Max:    255,
+	})
+
+	collection.Fields.Add(&core.DateField{
+		Name: "expires",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_share_links_slug", true, "slug", "")
+	collection.AddIndex("idx_share_links_site", false, "site", "")
+
+	return app.Save(collection)
+}
+
+// createImportedStatsCollection creates the imported_stats collection holding
+// daily rollups imported from Google Analytics or Plausible exports
+func createImportedStatsCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("imported_stats")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("imported_stats")
+
+	// Admin only access; rows are written by the import command
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "source",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{"plausible", "ga4"},
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "day",
+		Required: true,
+		Max:      10,
+	})
+
+	// Breakdown property (path, referrer, ...); empty for the daily totals
+	collection.Fields.Add(&core.TextField{
+		Name: "dimension",
+		Max:  32,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "value",
+		Max:  2048,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "pageviews",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "visitors",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	// One row per site, source, day and property value
+	collection.AddIndex("idx_imported_stats_row", true, "site, source, day, dimension, value", "")
+	collection.AddIndex("idx_imported_stats_query", false, "site, dimension, day", "")
+
+	return app.Save(collection)
+}
+
+// createReportSubscriptionsCollection creates the report_subscriptions
+// collection of weekly and monthly email digests
+func createReportSubscriptionsCollection(app core.App) error {
+	// Check if collection already exists
+	existing, _ := app.FindCollectionByNameOrId("report_subscriptions")
+	if existing != nil {
+		return nil
+	}
+
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	usersCollection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return err
+	}
+
+	collection := core.NewBaseCollection("report_subscriptions")
+
+	// Admin only access; members subscribe through the report endpoints
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	// Add fields
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	// The user who subscribed themselves; empty for addresses added by an editor
+	collection.Fields.Add(&core.RelationField{
+		Name:          "user",
+		CollectionId:  usersCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.EmailField{
+		Name:     "email",
+		Required: true,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "frequency",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{"weekly", "monthly"},
+	})
+
+	// End of the last period sent, so a missed hour or restart never sends twice
+	collection.Fields.Add(&core.DateField{
+		Name: "last_sent",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_report_subscriptions_recipient", true, "site, email, frequency", "")
+
+	return app.Save(collection)
+}
+
+// createAlertCollections creates the alert_rules collection of per-site
+// traffic alerts and the alert_events collection recording when they fired
+func createAlertCollections(app core.App) error {
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	rules, _ := app.FindCollectionByNameOrId("alert_rules")
+	if rules == nil {
+		rules = core.NewBaseCollection("alert_rules")
+
+		// Admin only access; editors manage rules through the alert endpoints
+		rules.ListRule = nil
+		rules.ViewRule = nil
+		rules.CreateRule = nil
+		rules.UpdateRule = nil
+		rules.DeleteRule = nil
+
+		rules.Fields.Add(&core.RelationField{
+			Name:          "site",
+			Required:      true,
+			CollectionId:  sitesCollection.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+
+		rules.Fields.Add(&core.SelectField{
+			Name:      "kind",
+			Required:  true,
+			MaxSelect: 1,
+			Values:    []string{"spike", "drop", "silence"},
+		})
+
+		// Pageviews per hour for spike, percent of the trailing average for
+		// drop, hours without pageviews for silence
+		rules.Fields.Add(&core.NumberField{
+			Name:     "threshold",
+			Required: true,
+		})
+
+		rules.Fields.Add(&core.EmailField{
+			Name: "email",
+		})
+
+		rules.Fields.Add(&core.URLField{
+			Name: "webhook_url",
+		})
+
+		rules.Fields.Add(&core.BoolField{
+			Name: "active",
+		})
+
+		// Whether the condition currently holds, so each incident notifies once
+		rules.Fields.Add(&core.BoolField{
+			Name: "firing",
+		})
+
+		rules.Fields.Add(&core.DateField{
+			Name: "last_triggered",
+		})
+
+		rules.Fields.Add(&core.AutodateField{
+			Name:     "created",
+			OnCreate: true,
+		})
+
+		rules.Fields.Add(&core.AutodateField{
+			Name:     "updated",
+			OnCreate: true,
+			OnUpdate: true,
+		})
+
+		rules.AddIndex("idx_alert_rules_site", false, "site", "")
+
+		if err := app.Save(rules); err != nil {
+			return err
+		}
+	}
+
+	existing, _ := app.FindCollectionByNameOrId("alert_events")
+	if existing != nil {
+		return nil
+	}
+
+	collection := core.NewBaseCollection("alert_events")
+
+	// Admin only access; history is read through the alert endpoints
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "rule",
+		Required:      true,
+		CollectionId:  rules.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "status",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{"triggered", "resolved"},
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "message",
+		Max:  1024,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name: "value",
+	})
+
+	// Delivery failures, empty if every channel succeeded
+	collection.Fields.Add(&core.TextField{
+		Name: "error",
+		Max:  1024,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_alert_events_site_created", false, "site, created", "")
+
+	return app.Save(collection)
+}
+
+// createWebhookCollections creates the webhooks collection of per-site
+// outgoing webhooks and the webhook_deliveries log and retry queue
+func createWebhookCollections(app core.App) error {
+	sitesCollection, err := app.FindCollectionByNameOrId("sites")
+	if err != nil {
+		return err
+	}
+
+	webhooks, _ := app.FindCollectionByNameOrId("webhooks")
+	if webhooks == nil {
+		webhooks = core.NewBaseCollection("webhooks")
+
+		// Admin only access; editors manage webhooks through the webhook endpoints
+		webhooks.ListRule = nil
+		webhooks.ViewRule = nil
+		webhooks.CreateRule = nil
+		webhooks.UpdateRule = nil
+		webhooks.DeleteRule = nil
+
+		webhooks.Fields.Add(&core.RelationField{
+			Name:          "site",
+			Required:      true,
+			CollectionId:  sitesCollection.Id,
+			MaxSelect:     1,
+			CascadeDelete: true,
+		})
+
+		webhooks.Fields.Add(&core.URLField{
+			Name:     "url",
+			Required: true,
+		})
+
+		// HMAC-SHA256 key for the signature header
+		webhooks.Fields.Add(&core.TextField{
+			Name:     "secret",
+			Required: true,
+			Hidden:   true,
+			Max:      64,
+		})
+
+		webhooks.Fields.Add(&core.SelectField{
+			Name:      "events",
+			Required:  true,
+			MaxSelect: 2,
+			Values:    []string{"pageview", "goal"},
+		})
+
+		webhooks.Fields.Add(&core.BoolField{
+			Name: "active",
+		})
+
+		webhooks.Fields.Add(&core.AutodateField{
+			Name:     "created",
+			OnCreate: true,
+		})
+
+		webhooks.Fields.Add(&core.AutodateField{
+			Name:     "updated",
+			OnCreate: true,
+			OnUpdate: true,
+		})
+
+		webhooks.AddIndex("idx_webhooks_site", false, "site", "")
+
+		if err := app.Save(webhooks); err != nil {
+			return err
+		}
+	}
+
+	existing, _ := app.FindCollectionByNameOrId("webhook_deliveries")
+	if existing != nil {
+		return nil
+	}
+
+	collection := core.NewBaseCollection("webhook_deliveries")
+
+	// Admin only access; the log is read through the webhook endpoints
+	collection.ListRule = nil
+	collection.ViewRule = nil
+	collection.CreateRule = nil
+	collection.UpdateRule = nil
+	collection.DeleteRule = nil
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "webhook",
+		Required:      true,
+		CollectionId:  webhooks.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "site",
+		Required:      true,
+		CollectionId:  sitesCollection.Id,
+		MaxSelect:     1,
+		CascadeDelete: true,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "event",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{"pageview", "goal"},
+	})
+
+	collection.Fields.Add(&core.JSONField{
+		Name:    "payload",
+		MaxSize: 65536,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "status",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{"pending", "delivered", "failed"},
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "attempts",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.DateField{
+		Name: "next_attempt",
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "response_status",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "error",
+		Max:  1024,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_webhook_deliveries_queue", false, "status, next_attempt", "")
+	collection.AddIndex("idx_webhook_deliveries_site_created", false, "site, created", "")
+
+	return app.Save(collection)
+}
@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"net/url"
+	"strings"
+)
+
+// The backfills below derive fields the way ingestion did when each
+// migration was written. They're copies rather than calls into the handlers
+// package, so later changes to ingestion can't change what an old migration
+// does, and they must not be changed once released.
+
+// userAgentInfo is the browser, OS and device class of a User-Agent
+type userAgentInfo struct {
+	Browser string
+	OS      string
+	Device  string
+}
+
+// parseUserAgent is handlers.ParseUserAgent as of 1792281600_initial_schema.go
+func parseUserAgent(ua string) userAgentInfo {
+	if ua == "" {
+		return userAgentInfo{}
+	}
+
+	lower := strings.ToLower(ua)
+	for _, marker := range []string{"bot", "crawler", "spider", "slurp", "headless", "curl/", "wget/", "python-requests"} {
+		if strings.Contains(lower, marker) {
+			return userAgentInfo{Browser: "Bot", OS: "Other", Device: "bot"}
+		}
+	}
+
+	info := userAgentInfo{Browser: "Other", OS: "Other", Device: "desktop"}
+
+	switch {
+	case strings.Contains(ua, "Edg/"), strings.Contains(ua, "EdgA/"), strings.Contains(ua, "EdgiOS/"):
+		info.Browser = "Edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		info.Browser = "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		info.Browser = "Samsung Internet"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		info.Browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		info.Browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		info.Browser = "Safari"
+	case strings.Contains(ua, "MSIE "), strings.Contains(ua, "Trident/"):
+		info.Browser = "Internet Explorer"
+	}
+
+	switch {
+	case strings.Contains(ua, "Windows"):
+		info.OS = "Windows"
+	case strings.Contains(ua, "Android"):
+		info.OS = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		info.OS = "iOS"
+	case strings.Contains(ua, "CrOS"):
+		info.OS = "ChromeOS"
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		info.OS = "macOS"
+	case strings.Contains(ua, "Linux"):
+		info.OS = "Linux"
+	}
+
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"):
+		info.Device = "tablet"
+	case strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		info.Device = "tablet"
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		info.Device = "mobile"
+	}
+
+	return info
+}
+
+// utmParams are the campaign parameters of a page URL
+type utmParams struct {
+	Source   string
+	Medium   string
+	Campaign string
+}
+
+// parseUTM is handlers.ParseUTM as of 1792332000_pageviews_utm.go
+func parseUTM(path string) utmParams {
+	_, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return utmParams{}
+	}
+	query, _, _ = strings.Cut(query, "#")
+
+	params, _ := url.ParseQuery(query)
+	value := func(name string) string {
+		value := strings.TrimSpace(params.Get(name))
+		if len(value) > 255 {
+			value = strings.ToValidUTF8(value[:255], "")
+		}
+		return value
+	}
+	return utmParams{
+		Source:   value("utm_source"),
+		Medium:   value("utm_medium"),
+		Campaign: value("utm_campaign"),
+	}
+}
+
+// referrerSource is the referrer_source of a referrer as of
+// 1792353600_pageviews_referrer_source.go: its lowercase host without port
+// or "www.", or "" if it isn't a URL with a host
+func referrerSource(referrer string) string {
+	referrer = strings.TrimSpace(referrer)
+	if referrer == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(referrer)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+
+	host := parsed.Host
+	if colon := strings.LastIndex(host, ":"); colon != -1 {
+		if !strings.Contains(host, "]") || strings.LastIndex(host, "]") < colon {
+			host = host[:colon]
+		}
+	}
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}